@@ -0,0 +1,56 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type acpushDefaultsV1JsonParser struct{}
+
+type acpushDefaultsV1 struct {
+	Prefixes []string          `json:"prefixes"`
+	Endpoint string            `json:"endpoint"`
+	Labels   map[string]string `json:"labels"`
+}
+
+func init() {
+	addParser("acpushDefaults", "v1", &acpushDefaultsV1JsonParser{})
+	registerSubDir("acpush.d", []string{"acpushDefaults"})
+}
+
+func (p *acpushDefaultsV1JsonParser) parse(config *Config, raw []byte) error {
+	var defaults acpushDefaultsV1
+	if err := json.Unmarshal(raw, &defaults); err != nil {
+		return err
+	}
+	if len(defaults.Prefixes) == 0 {
+		return fmt.Errorf("no prefixes specified")
+	}
+	if len(defaults.Endpoint) == 0 && len(defaults.Labels) == 0 {
+		return fmt.Errorf("neither endpoint nor labels specified")
+	}
+	for _, prefix := range defaults.Prefixes {
+		if _, ok := config.PushDefaultsPerPrefix[prefix]; ok {
+			return fmt.Errorf("push defaults for prefix %q are already specified", prefix)
+		}
+		config.PushDefaultsPerPrefix[prefix] = PushDefaults{
+			Endpoint: defaults.Endpoint,
+			Labels:   defaults.Labels,
+		}
+	}
+	return nil
+}
@@ -69,6 +69,16 @@ func (h *basicAuthHeaderer) Header() http.Header {
 	return headers
 }
 
+// Header returns a header with the credentials for basic
+// authentication, making BasicCredentials a Headerer.
+func (c BasicCredentials) Header() http.Header {
+	h := basicAuthHeaderer{
+		user:     c.User,
+		password: c.Password,
+	}
+	return h.Header()
+}
+
 type oAuthBearerTokenHeaderer struct {
 	token string
 }
@@ -25,6 +25,7 @@ import (
 	"strings"
 
 	"github.com/appc/acpush/Godeps/_workspace/src/github.com/coreos/rkt/common"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/ghodss/yaml"
 )
 
 // Headerer is an interface for getting additional HTTP headers to use
@@ -38,11 +39,19 @@ type BasicCredentials struct {
 	Password string
 }
 
+// PushDefaults holds the default push endpoint and labels used by
+// acpush for images whose name starts with a given prefix.
+type PushDefaults struct {
+	Endpoint string
+	Labels   map[string]string
+}
+
 // Config is a single place where configuration for rkt frontend needs
 // resides.
 type Config struct {
 	AuthPerHost                  map[string]Headerer
 	DockerCredentialsPerRegistry map[string]BasicCredentials
+	PushDefaultsPerPrefix        map[string]PushDefaults
 }
 
 type configParser interface {
@@ -115,9 +124,26 @@ func GetConfig() (*Config, error) {
 // from given system path overridden with configuration from given
 // local path.
 func GetConfigFrom(system, local string) (*Config, error) {
+	return getConfigFrom(system, local, nil)
+}
+
+// GetConfigFromLenient works like GetConfigFrom, but configuration
+// files that fail to parse are skipped instead of aborting the whole
+// read. The errors for the skipped files are returned in the second
+// return value.
+func GetConfigFromLenient(system, local string) (*Config, []error, error) {
+	var errs []error
+	cfg, err := getConfigFrom(system, local, &errs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, errs, nil
+}
+
+func getConfigFrom(system, local string, errs *[]error) (*Config, error) {
 	cfg := newConfig()
 	for _, cd := range []string{system, local} {
-		subcfg, err := GetConfigFromDir(cd)
+		subcfg, err := getConfigFromDir(cd, errs)
 		if err != nil {
 			return nil, err
 		}
@@ -129,13 +155,20 @@ func GetConfigFrom(system, local string) (*Config, error) {
 // GetConfigFromDir gets the Config instance with configuration taken
 // from given directory.
 func GetConfigFromDir(dir string) (*Config, error) {
+	return getConfigFromDir(dir, nil)
+}
+
+// getConfigFromDir gets the Config instance with configuration taken
+// from given directory. If errs is not nil, errors from parsing single
+// configuration files are appended to it instead of being returned.
+func getConfigFromDir(dir string, errs *[]error) (*Config, error) {
 	subcfg := newConfig()
 	if valid, err := validDir(dir); err != nil {
 		return nil, err
 	} else if !valid {
 		return subcfg, nil
 	}
-	if err := readConfigDir(subcfg, dir); err != nil {
+	if err := readConfigDir(subcfg, dir, errs); err != nil {
 		return nil, err
 	}
 	return subcfg, nil
@@ -145,10 +178,11 @@ func newConfig() *Config {
 	return &Config{
 		AuthPerHost:                  make(map[string]Headerer),
 		DockerCredentialsPerRegistry: make(map[string]BasicCredentials),
+		PushDefaultsPerPrefix:        make(map[string]PushDefaults),
 	}
 }
 
-func readConfigDir(config *Config, dir string) error {
+func readConfigDir(config *Config, dir string, errs *[]error) error {
 	for csd, kinds := range configSubDirs {
 		d := filepath.Join(dir, csd)
 		if valid, err := validDir(d); err != nil {
@@ -156,7 +190,7 @@ func readConfigDir(config *Config, dir string) error {
 		} else if !valid {
 			continue
 		}
-		configWalker := getConfigWalker(config, kinds, d)
+		configWalker := getConfigWalker(config, kinds, d, errs)
 		if err := filepath.Walk(d, configWalker); err != nil {
 			return err
 		}
@@ -178,7 +212,7 @@ func validDir(path string) (bool, error) {
 	return true, nil
 }
 
-func getConfigWalker(config *Config, kinds []string, root string) filepath.WalkFunc {
+func getConfigWalker(config *Config, kinds []string, root string, errs *[]error) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -186,31 +220,74 @@ func getConfigWalker(config *Config, kinds []string, root string) filepath.WalkF
 		if path == root {
 			return nil
 		}
-		return readFile(config, info, path, kinds)
+		return readFile(config, info, path, kinds, errs)
 	}
 }
 
-func readFile(config *Config, info os.FileInfo, path string, kinds []string) error {
+func readFile(config *Config, info os.FileInfo, path string, kinds []string, errs *[]error) error {
+	if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+		target, targetInfo, err := resolveSymlink(path)
+		if err != nil {
+			return fileError(err, errs)
+		}
+		// Symlinked directories are not followed to avoid walking
+		// into loops.
+		if targetInfo.IsDir() {
+			return nil
+		}
+		path, info = target, targetInfo
+	}
 	if valid, err := validConfigFile(info); err != nil {
 		return err
 	} else if !valid {
 		return nil
 	}
 	if err := parseConfigFile(config, path, kinds); err != nil {
-		return err
+		return fileError(err, errs)
 	}
 	return nil
 }
 
+// fileError returns err, unless errs is not nil, in which case err is
+// appended to it and nil is returned.
+func fileError(err error, errs *[]error) error {
+	if errs != nil {
+		*errs = append(*errs, err)
+		return nil
+	}
+	return err
+}
+
+// resolveSymlink returns the path and file info of the file the
+// symlink at path eventually points to. filepath.EvalSymlinks gives up
+// on symlink loops.
+func resolveSymlink(path string) (string, os.FileInfo, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve symlink %q: %v", path, err)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve symlink %q: %v", path, err)
+	}
+	return target, info, nil
+}
+
 func validConfigFile(info os.FileInfo) (bool, error) {
 	mode := info.Mode()
 	switch {
 	case mode.IsDir():
 		return false, filepath.SkipDir
 	case mode.IsRegular():
-		return filepath.Ext(info.Name()) == ".json", nil
+		switch filepath.Ext(info.Name()) {
+		case ".json", ".yaml", ".yml":
+			return true, nil
+		default:
+			return false, nil
+		}
 	case mode&os.ModeSymlink == os.ModeSymlink:
-		// TODO: support symlinks?
+		// Symlinks are resolved in readFile, so this is a
+		// symlink that could not be followed.
 		return false, nil
 	default:
 		return false, nil
@@ -227,9 +304,18 @@ func parseConfigFile(config *Config, path string, kinds []string) error {
 	if err != nil {
 		return err
 	}
+	// YAML files are converted to JSON, so the parsers only ever
+	// have to deal with the latter.
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		raw, err = yaml.YAMLToJSON(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse %q: %v", path, err)
+		}
+	}
 	var header configHeader
 	if err := json.Unmarshal(raw, &header); err != nil {
-		return err
+		return fmt.Errorf("failed to parse %q: %v", path, err)
 	}
 	if len(header.RktKind) == 0 {
 		return fmt.Errorf("no rktKind specified in %q", path)
@@ -279,4 +365,7 @@ func mergeConfigs(config *Config, subconfig *Config) {
 	for registry, creds := range subconfig.DockerCredentialsPerRegistry {
 		config.DockerCredentialsPerRegistry[registry] = creds
 	}
+	for prefix, defaults := range subconfig.PushDefaultsPerPrefix {
+		config.PushDefaultsPerPrefix[prefix] = defaults
+	}
 }
@@ -0,0 +1,76 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSymlinkedConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authDir := filepath.Join(dir, "auth.d")
+	if err := os.Mkdir(authDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "example.json")
+	auth := `{"rktKind": "auth", "rktVersion": "v1", "domains": ["example.com"], "type": "basic", "credentials": {"user": "user", "password": "pass"}}`
+	if err := ioutil.WriteFile(target, []byte(auth), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(authDir, "foo.json")); err != nil {
+		t.Fatal(err)
+	}
+	loop := filepath.Join(authDir, "loop.json")
+	if err := os.Symlink(filepath.Join(authDir, "loop2.json"), loop); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(loop, filepath.Join(authDir, "loop2.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	config, errs, err := GetConfigFromLenient(dir, filepath.Join(dir, "nonexistent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, ok := config.AuthPerHost["example.com"]
+	if !ok {
+		t.Fatalf("the symlinked auth config was not loaded, errors: %v", errs)
+	}
+	if got := h.Header().Get("Authorization"); got != "Basic dXNlcjpwYXNz" {
+		t.Errorf("got Authorization %q, want %q", got, "Basic dXNlcjpwYXNz")
+	}
+
+	// Both symlinks of the loop are rejected.
+	if len(errs) != 2 {
+		t.Fatalf("got errors %v, want one for each symlink of the loop", errs)
+	}
+	for _, err := range errs {
+		if !strings.Contains(err.Error(), "failed to resolve symlink") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if _, err := GetConfigFrom(dir, filepath.Join(dir, "nonexistent")); err == nil {
+		t.Error("expected the symlink loop to fail the strict config reading")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/spf13/cobra"
+
+	"github.com/appc/acpush/lib"
+)
+
+// version is the version of acpush, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+var (
+	flagCapabilitiesOutput string
+
+	cmdCapabilities = &cobra.Command{
+		Use:     "capabilities",
+		Aliases: []string{"version"},
+		Short:   "Prints the version of acpush and what it supports",
+		Run:     runCapabilities,
+	}
+)
+
+func init() {
+	cmdCapabilities.Flags().StringVarP(&flagCapabilitiesOutput, "output", "o", "text", "Output format: text or json")
+	cmdACPush.AddCommand(cmdCapabilities)
+}
+
+type capabilitiesOutput struct {
+	Version string `json:"version"`
+	lib.Capabilities
+}
+
+func runCapabilities(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	out := capabilitiesOutput{version, lib.SupportedCapabilities()}
+	switch flagCapabilitiesOutput {
+	case "text":
+		fmt.Printf("acpush version %s\n", out.Version)
+		fmt.Printf("push protocol: %s\n", strings.Join(out.ACIPushVersions, ", "))
+		fmt.Printf("acVersion: up to %s\n", out.ACVersion)
+		fmt.Printf("formats: %s\n", strings.Join(out.Formats, ", "))
+		fmt.Printf("compressions: %s\n", strings.Join(out.Compressions, ", "))
+		fmt.Printf("features: %s\n", strings.Join(out.Features, ", "))
+	case "json":
+		blob, err := json.MarshalIndent(out, "", "\t")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(blob))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format: %q\n", flagCapabilitiesOutput)
+		os.Exit(1)
+	}
+}
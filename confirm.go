@@ -0,0 +1,67 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/golang.org/x/crypto/ssh/terminal"
+
+	"github.com/appc/acpush/lib"
+)
+
+// confirmMu serializes the confirmations of the pushes performed in
+// parallel.
+var confirmMu sync.Mutex
+
+// confirmPush describes the push and asks on the terminal whether to go
+// ahead with it. Pushes are declined when stdin isn't a terminal, unless
+// --yes is given.
+func confirmPush(info lib.PushInfo) bool {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+
+	var labels []string
+	for name, value := range info.Labels {
+		labels = append(labels, name+"="+value)
+	}
+	sort.Strings(labels)
+	fmt.Fprintf(os.Stderr, "Image:    %s\n", info.Name)
+	fmt.Fprintf(os.Stderr, "Labels:   %s\n", strings.Join(labels, ", "))
+	fmt.Fprintf(os.Stderr, "Endpoint: %s\n", info.Endpoint)
+	if info.Size >= 0 {
+		fmt.Fprintf(os.Stderr, "Size:     %d bytes\n", info.Size)
+	}
+
+	if flagYes {
+		return true
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintln(os.Stderr, "not a terminal, refusing to push without --yes")
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Push to %s? [y/N] ", info.Endpoint)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keyValueFlag is a flag accepting key=value pairs, which can be given
+// multiple times.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	var pairs []string
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+func (f keyValueFlag) Type() string {
+	return "key=value"
+}
+
+// tlsVersions are the TLS versions accepted by tlsVersionFlag.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersionFlag is a flag accepting a TLS version, such as 1.2. Its zero
+// value leaves the version to the default.
+type tlsVersionFlag uint16
+
+func (f tlsVersionFlag) String() string {
+	for name, v := range tlsVersions {
+		if uint16(f) == v {
+			return name
+		}
+	}
+	return ""
+}
+
+func (f *tlsVersionFlag) Set(s string) error {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	*f = tlsVersionFlag(v)
+	return nil
+}
+
+func (f tlsVersionFlag) Type() string {
+	return "version"
+}
+
+// byteUnits are the units of the sizes accepted by parseByteSize.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// parseByteSize parses a size in bytes, optionally followed by a unit such
+// as MB or MiB.
+func parseByteSize(s string) (int64, error) {
+	unit := int64(1)
+	num := s
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			unit, num = u.size, strings.TrimSuffix(s, u.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a positive number of bytes such as 5MB", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// rateLimitFlag is a flag accepting upload rate limits in bytes per second,
+// either for every host or, as host=rate, for a given one. It can be given
+// multiple times.
+type rateLimitFlag struct {
+	global int64
+	hosts  map[string]int64
+}
+
+func (f *rateLimitFlag) String() string {
+	var limits []string
+	if f.global != 0 {
+		limits = append(limits, strconv.FormatInt(f.global, 10))
+	}
+	for host, rate := range f.hosts {
+		limits = append(limits, host+"="+strconv.FormatInt(rate, 10))
+	}
+	sort.Strings(limits)
+	return strings.Join(limits, ",")
+}
+
+func (f *rateLimitFlag) Set(s string) error {
+	host, rate := "", s
+	if parts := strings.SplitN(s, "=", 2); len(parts) == 2 {
+		if parts[0] == "" {
+			return fmt.Errorf("expected rate or host=rate, got %q", s)
+		}
+		host, rate = parts[0], parts[1]
+	}
+	n, err := parseByteSize(rate)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		f.global = n
+		return nil
+	}
+	if f.hosts == nil {
+		f.hosts = make(map[string]int64)
+	}
+	f.hosts[host] = n
+	return nil
+}
+
+func (f *rateLimitFlag) Type() string {
+	return "rate"
+}
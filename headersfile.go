@@ -0,0 +1,96 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// loadHeadersFile reads the headers to set on every request from the file
+// at path, which holds either a JSON object mapping names to values or
+// "Name: value" lines. Empty lines and lines starting with # are ignored in
+// the latter.
+func loadHeadersFile(path string) (http.Header, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	if trimmed := bytes.TrimSpace(blob); len(trimmed) > 0 && trimmed[0] == '{' {
+		var values map[string]string
+		if err := json.Unmarshal(trimmed, &values); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+		for name, value := range values {
+			if err := addHeader(header, name, value); err != nil {
+				return nil, fmt.Errorf("error in %s: %v", path, err)
+			}
+		}
+		return header, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(blob))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("error in %s, line %d: expected Name: value", path, n)
+		}
+		if err := addHeader(header, strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])); err != nil {
+			return nil, fmt.Errorf("error in %s, line %d: %v", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// addHeader validates the header and adds it.
+func addHeader(header http.Header, name, value string) error {
+	if !validHeaderName(name) {
+		return fmt.Errorf("invalid header name: %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid value for header %q", name)
+	}
+	header.Add(name, value)
+	return nil
+}
+
+// validHeaderName returns whether s is a valid HTTP header name.
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
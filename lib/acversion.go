@@ -0,0 +1,54 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema/types"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/coreos/go-semver/semver"
+)
+
+// maxSupportedACVersion returns the newest acVersion acpush knows about,
+// the version of the spec it is built against without its metadata.
+func maxSupportedACVersion() string {
+	v := semver.Version(schema.AppContainerVersion)
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// checkACVersion checks that the acVersion of a manifest is within the
+// given bounds, either of which may be empty for no bound.
+func checkACVersion(v types.SemVer, min, max string) error {
+	if min != "" {
+		minv, err := types.NewSemVer(min)
+		if err != nil {
+			return fmt.Errorf("invalid minimum acVersion %q: %v", min, err)
+		}
+		if v.LessThanExact(*minv) {
+			return fmt.Errorf("manifest acVersion %s is older than the minimum %s", v, min)
+		}
+	}
+	if max != "" {
+		maxv, err := types.NewSemVer(max)
+		if err != nil {
+			return fmt.Errorf("invalid maximum acVersion %q: %v", max, err)
+		}
+		if maxv.LessThanExact(v) {
+			return fmt.Errorf("manifest acVersion %s is newer than the maximum %s", v, max)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// JitterNone waits for the computed delay exactly.
+	JitterNone = "none"
+	// JitterFull waits for a random delay between zero and the computed
+	// one.
+	JitterFull = "full"
+	// JitterEqual waits for half the computed delay plus a random delay
+	// up to the other half.
+	JitterEqual = "equal"
+)
+
+const (
+	// completionRetryDelay is the delay before retrying a failed
+	// completion request the first time, doubled for every following
+	// retry up to maxCompletionRetryDelay.
+	completionRetryDelay    = time.Second
+	maxCompletionRetryDelay = 30 * time.Second
+)
+
+// jitterRand is seeded once per process so that concurrent acpush processes
+// don't wait for the same delays. It is guarded by jitterMu, as rand.Rand
+// isn't safe for concurrent use.
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// checkJitter returns an error if the jitter strategy is unknown.
+func checkJitter(jitter string) error {
+	switch jitter {
+	case "", JitterNone, JitterFull, JitterEqual:
+		return nil
+	}
+	return fmt.Errorf("unknown jitter strategy: %q", jitter)
+}
+
+// retryDelay applies the Jitter strategy to delay, the time to wait before
+// trying again.
+func (u Uploader) retryDelay(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		return delay
+	}
+	switch u.Jitter {
+	case JitterNone:
+		return delay
+	case JitterEqual:
+		return delay/2 + randDuration(delay-delay/2)
+	default:
+		return randDuration(delay)
+	}
+}
+
+// randDuration returns a random duration in [0, max].
+func randDuration(max time.Duration) time.Duration {
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(max) + 1))
+}
+
+// completionBackoff returns the delay before the given retry of a failed
+// completion request, counting from 1.
+func (u Uploader) completionBackoff(retry int) time.Duration {
+	delay := completionRetryDelay
+	for i := 1; i < retry && delay < maxCompletionRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxCompletionRetryDelay {
+		delay = maxCompletionRetryDelay
+	}
+	return u.retryDelay(delay)
+}
+
+// statusError is the unexpected status of a response.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("bad HTTP status code: %d", int(e))
+}
+
+// transient returns whether a request failing with err may succeed when sent
+// again: it couldn't reach the server, the connection was lost, or the
+// server replied with a 5xx or 429 status.
+func transient(err error) bool {
+	if serr, ok := err.(statusError); ok {
+		return serr >= 500 || serr == http.StatusTooManyRequests
+	}
+	if isConnectionError(err) {
+		return true
+	}
+	uerr, ok := err.(*url.Error)
+	return ok && (uerr.Err == io.EOF || uerr.Err == io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"io"
+)
+
+// readCounter counts the reads made of a reader, and the size of the
+// largest one, to tell whether the read buffer is used.
+type readCounter struct {
+	r     io.Reader
+	reads int
+	max   int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.reads++
+	if n > c.max {
+		c.max = n
+	}
+	return n, err
+}
+
+// bufferBody wraps a file body in a reader of ReadBufferSize bytes, which
+// reads from it through c.
+func (u Uploader) bufferBody(body io.Reader, c *readCounter) io.Reader {
+	c.r = body
+	return bufio.NewReaderSize(c, u.ReadBufferSize)
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+// Capabilities describes what this build of acpush supports.
+type Capabilities struct {
+	// ACIPushVersions are the versions of the push protocol spoken.
+	ACIPushVersions []string `json:"aci_push_versions"`
+	// ACVersion is the newest acVersion of the manifests accepted.
+	ACVersion string `json:"ac_version"`
+	// Formats are the image formats that can be pushed.
+	Formats []string `json:"formats"`
+	// Compressions are the compressions that can be applied while
+	// uploading.
+	Compressions []string `json:"compressions"`
+	// Features are the optional parts of the push protocol implemented.
+	Features []string `json:"features"`
+}
+
+// SupportedCapabilities returns the capabilities of acpush.
+func SupportedCapabilities() Capabilities {
+	return Capabilities{
+		ACIPushVersions: []string{"0.0.1"},
+		ACVersion:       maxSupportedACVersion(),
+		Formats:         []string{FormatACI, FormatOCI, FormatACIDir},
+		Compressions:    []string{CompressionGzip},
+		Features: []string{
+			"part-order",
+			"ac-version-bounds",
+			"no-overwrite",
+			"content-addressable",
+			"idempotency-key",
+			"job-polling",
+			"resume-completion",
+			"tus",
+			"inline-manifest",
+			"no-completion",
+		},
+	}
+}
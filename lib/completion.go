@@ -0,0 +1,66 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// completionFields returns the JSON names of the fields of completeMsg.
+func completionFields() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(completeMsg{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// checkCompletionExtra checks that the extra fields of the completion don't
+// replace the ones of the push protocol.
+func checkCompletionExtra(extra map[string]interface{}) error {
+	reserved := completionFields()
+	for name := range extra {
+		if reserved[name] {
+			return fmt.Errorf("the completion field %q is part of the push protocol and can't be set", name)
+		}
+	}
+	return nil
+}
+
+// withExtraFields returns the JSON object of msg with the extra fields
+// added.
+func withExtraFields(msg interface{}, extra map[string]interface{}) ([]byte, error) {
+	blob, err := json.Marshal(msg)
+	if err != nil || len(extra) == 0 {
+		return blob, err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range extra {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
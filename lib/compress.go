@@ -0,0 +1,106 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/aci"
+)
+
+// CompressionGzip compresses the image with gzip while uploading it.
+const CompressionGzip = "gzip"
+
+// defaultCompressLevel is the compression level used when CompressLevel is
+// unset, the same as gzip's default one.
+const defaultCompressLevel = 6
+
+// compressImage wraps the image in a compressing reader if compression was
+// requested and the image isn't already compressed. The second return value
+// reports whether the image is being compressed.
+func (u Uploader) compressImage(image io.ReadCloser) (io.ReadCloser, bool, error) {
+	switch u.Compress {
+	case "":
+		return image, false, nil
+	case CompressionGzip:
+	default:
+		return nil, false, fmt.Errorf("unknown compression: %q", u.Compress)
+	}
+	level, err := u.compressLevel()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var src io.Reader = image
+	if s, ok := image.(*streamedImage); ok && s.typ != aci.TypeTar {
+		u.warnf("image is already compressed (%s), not compressing it", s.typ)
+		return image, false, nil
+	}
+	if f, ok := image.(*os.File); ok {
+		typ, err := aci.DetectFileType(f)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := f.Seek(0, 0); err != nil {
+			return nil, false, err
+		}
+		switch typ {
+		case aci.TypeGzip, aci.TypeBzip2, aci.TypeXz:
+			u.warnf("image is already compressed (%s), not compressing it", typ)
+			return image, false, nil
+		}
+		// The compressed stream has no known size, so the progress
+		// is drawn for the reads from the file instead.
+		if u.Debug {
+			src, err = u.genProgressBar(f, f, "ACI")
+			if err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	return gzipStream(src, level), true, nil
+}
+
+// compressLevel returns the gzip compression level of Compress and
+// ContentEncoding.
+func (u Uploader) compressLevel() (int, error) {
+	level := u.CompressLevel
+	if level == 0 {
+		level = defaultCompressLevel
+	}
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return 0, fmt.Errorf("invalid compression level %d, expected 1 to 9", level)
+	}
+	return level, nil
+}
+
+// gzipStream returns a reader of the contents of r, gzip compressed at the
+// given level.
+func gzipStream(r io.Reader, level int) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		// The level was validated already.
+		gw, _ := gzip.NewWriterLevel(pw, level)
+		_, err := io.Copy(gw, r)
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
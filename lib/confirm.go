@@ -0,0 +1,54 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"os"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/discovery"
+)
+
+// ErrNotConfirmed is the error returned by Upload when Confirm declines the
+// push.
+var ErrNotConfirmed = errors.New("push not confirmed")
+
+// PushInfo describes a push about to be initiated, for Confirm.
+type PushInfo struct {
+	// Name is the image name, after the Repository override.
+	Name string
+	// Labels are the labels used for discovery.
+	Labels map[string]string
+	// Endpoint is the URL the upload is initiated at.
+	Endpoint string
+	// Size is the size of the image file, or -1 if it isn't known.
+	Size int64
+}
+
+func (u Uploader) pushInfo(app *discovery.App, endpoint string) PushInfo {
+	info := PushInfo{
+		Name:     app.Name.String(),
+		Labels:   make(map[string]string),
+		Endpoint: endpoint,
+		Size:     -1,
+	}
+	for name, value := range app.Labels {
+		info.Labels[name.String()] = value
+	}
+	if finfo, err := os.Stat(u.Acipath); err == nil && finfo.Mode().IsRegular() {
+		info.Size = finfo.Size()
+	}
+	return info
+}
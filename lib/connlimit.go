@@ -0,0 +1,94 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// connLimiters holds the semaphores bounding the requests in flight to
+// each host, shared by the pushes of UploadMirror.
+type connLimiters struct {
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+// connLimiter returns the semaphore of host, or nil if its requests aren't
+// limited.
+func (u Uploader) connLimiter(host string) chan struct{} {
+	if u.MaxConnsPerHost <= 0 || u.conns == nil {
+		return nil
+	}
+	u.conns.mu.Lock()
+	defer u.conns.mu.Unlock()
+	sem, ok := u.conns.sems[host]
+	if !ok {
+		sem = make(chan struct{}, u.MaxConnsPerHost)
+		u.conns.sems[host] = sem
+	}
+	return sem
+}
+
+// withConnLimiters returns the Uploader with the semaphores its pushes
+// share, creating them if it has none yet.
+func (u Uploader) withConnLimiters() Uploader {
+	if u.conns == nil && u.MaxConnsPerHost > 0 {
+		u.conns = &connLimiters{sems: make(map[string]chan struct{})}
+	}
+	return u
+}
+
+// connLimitTransport waits for a slot of the semaphore of the host before
+// sending a request, and releases it once the body of the response is
+// closed.
+type connLimitTransport struct {
+	rt http.RoundTripper
+	u  Uploader
+}
+
+func (t *connLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sem := t.u.connLimiter(req.URL.Host)
+	if sem == nil {
+		return t.rt.RoundTrip(req)
+	}
+	select {
+	case sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	release := func() { <-sem }
+	res, err := t.rt.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &releasingBody{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+// releasingBody releases the slot of its request once closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
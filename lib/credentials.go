@@ -0,0 +1,133 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// CredentialProvider provides the headers authenticating the requests to a
+// host. It is consulted for every request, so that it can mint or refresh
+// expiring credentials on demand.
+type CredentialProvider interface {
+	Credentials(host string) (http.Header, error)
+}
+
+// CredentialRefresher is implemented by the CredentialProviders caching
+// credentials. RefreshCredentials is called when a server rejects the
+// credentials of a host, for the next call to Credentials to return fresh
+// ones.
+type CredentialRefresher interface {
+	RefreshCredentials(host string) error
+}
+
+// retriesUnauthorized reports whether a request rejected with the 401
+// response is sent again, with a token acquired for its Bearer challenge or
+// Credentials refreshed. Static credentials would only be rejected again.
+func (u Uploader) retriesUnauthorized(res *http.Response) bool {
+	if _, ok := u.bearerChallenge(res); ok {
+		return true
+	}
+	_, ok := u.Credentials.(CredentialRefresher)
+	return ok
+}
+
+// retryUnauthorized sends the request again once, with fresh credentials,
+// after it was rejected with the 401 response res. The request can only be
+// sent again if its body can be replayed.
+func (u Uploader) retryUnauthorized(req *http.Request, header http.Header, res *http.Response) (*http.Response, error) {
+	host := req.URL.Host
+	if req.Body != nil && req.GetBody == nil {
+		return nil, fmt.Errorf("unauthorized by %s, and the request can't be sent again", host)
+	}
+	if c, ok := u.bearerChallenge(res); ok {
+		if err := u.acquireToken(host, c); err != nil {
+			return nil, err
+		}
+	} else if r, ok := u.Credentials.(CredentialRefresher); ok {
+		if err := r.RefreshCredentials(host); err != nil {
+			return nil, fmt.Errorf("error refreshing credentials for %s: %v", host, err)
+		}
+	}
+	if u.Debug {
+		stderr("unauthorized by %s, retrying with fresh credentials", host)
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	retry.Header = make(http.Header)
+	if err := u.setHeaders(retry, header); err != nil {
+		return nil, err
+	}
+	// The response is returned whatever its status, so that fresh
+	// credentials failing as well don't lead to another retry.
+	return u.httpClient().Do(retry)
+}
+
+// authorize runs the interceptors on the request, in order, stopping at the
+// first one returning an error.
+func (u Uploader) authorize(req *http.Request) error {
+	for _, intercept := range u.interceptors() {
+		if err := intercept(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interceptors returns the chain of functions run on every request before
+// it is sent: the authentication, SetHTTPHeaders included, followed by the
+// Interceptors.
+func (u Uploader) interceptors() []func(*http.Request) error {
+	return append([]func(*http.Request) error{u.authenticate}, u.Interceptors...)
+}
+
+// authenticate adds the headers of the Credentials provider and the ones set
+// by SetHTTPHeaders to the request. Unless AlwaysAuth is set, requests to
+// another host than the initiation endpoint's are assumed to be presigned
+// and are left as they are.
+func (u Uploader) authenticate(req *http.Request) error {
+	if u.initHost != "" && !u.AlwaysAuth && req.URL != nil && req.URL.Host != u.initHost {
+		if u.Debug {
+			stderr("not sending credentials to %s, which differs from the initiation host", req.URL.Host)
+		}
+		return nil
+	}
+	if u.Credentials != nil && req.URL != nil {
+		header, err := u.Credentials.Credentials(req.URL.Host)
+		if err != nil {
+			return fmt.Errorf("error getting credentials for %s: %v", req.URL.Host, err)
+		}
+		for k, v := range header {
+			req.Header[k] = append(req.Header[k], v...)
+		}
+	}
+	if req.URL != nil {
+		if token := u.cachedToken(req.URL.Host); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	if u.SetHTTPHeaders != nil {
+		u.SetHTTPHeaders(req)
+	}
+	return nil
+}
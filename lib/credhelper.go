@@ -0,0 +1,116 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// CredentialHelper is a CredentialProvider getting the credentials of each
+// host from an external program, in the way of docker's credential helpers:
+// the program is run with the "get" argument and the host on stdin, and
+// prints a JSON object with the Username and Secret for the host. A Secret
+// with no Username, or with "<token>" as Username, is sent as a bearer
+// token, others as basic credentials. Hosts for which the program prints
+// nothing, or an empty Secret, get no credentials.
+//
+// The credentials of each host are cached until refreshed, so that the
+// program runs once per host and push.
+type CredentialHelper struct {
+	// Program is the path or name of the program.
+	Program string
+
+	mu    sync.Mutex
+	cache map[string]http.Header
+}
+
+// credentialHelperReply is what credential helpers print for a host.
+type credentialHelperReply struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// credentialsNotFound is printed by docker's credential helpers for hosts
+// they hold no credentials for.
+const credentialsNotFound = "credentials not found"
+
+// Credentials returns the headers authenticating the requests to host.
+func (h *CredentialHelper) Credentials(host string) (http.Header, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if header, ok := h.cache[host]; ok {
+		return header, nil
+	}
+	header, err := h.get(host)
+	if err != nil {
+		return nil, err
+	}
+	if h.cache == nil {
+		h.cache = make(map[string]http.Header)
+	}
+	h.cache[host] = header
+	return header, nil
+}
+
+// RefreshCredentials forgets the cached credentials of host, for the
+// program to be run again.
+func (h *CredentialHelper) RefreshCredentials(host string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.cache, host)
+	return nil
+}
+
+func (h *CredentialHelper) get(host string) (http.Header, error) {
+	cmd := exec.Command(h.Program, "get")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = strings.NewReader(host)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(out, credentialsNotFound) {
+			return nil, nil
+		}
+		if out != "" {
+			return nil, fmt.Errorf("credential helper %s failed: %v: %s", h.Program, err, out)
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %v", h.Program, err)
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, nil
+	}
+	var reply credentialHelperReply
+	if err := json.Unmarshal(stdout.Bytes(), &reply); err != nil {
+		return nil, fmt.Errorf("invalid output of credential helper %s: %v", h.Program, err)
+	}
+	if reply.Secret == "" {
+		return nil, nil
+	}
+	header := make(http.Header)
+	if reply.Username == "" || reply.Username == "<token>" {
+		header.Set("Authorization", "Bearer "+reply.Secret)
+	} else {
+		auth := base64.StdEncoding.EncodeToString([]byte(reply.Username + ":" + reply.Secret))
+		header.Set("Authorization", "Basic "+auth)
+	}
+	return header, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+)
+
+// redactedHeaders are the headers whose values are never printed.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization"}
+
+// bodySize returns the size of the given request body, or -1 if it is not
+// known.
+func bodySize(body io.Reader) int64 {
+	switch b := body.(type) {
+	case nil:
+		return 0
+	case *bytes.Reader:
+		return int64(b.Len())
+	case *os.File:
+		finfo, err := b.Stat()
+		if err != nil {
+			return -1
+		}
+		return finfo.Size()
+	default:
+		return -1
+	}
+}
+
+// redactHeader returns a copy of header with the values of sensitive headers
+// replaced, which are the redactedHeaders and the RedactHeaders.
+func (u Uploader) redactHeader(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for k, v := range header {
+		redacted[k] = v
+	}
+	for _, names := range [][]string{redactedHeaders, u.RedactHeaders} {
+		for _, k := range names {
+			k = http.CanonicalHeaderKey(k)
+			if _, ok := redacted[k]; ok {
+				redacted[k] = []string{"REDACTED"}
+			}
+		}
+	}
+	return redacted
+}
+
+func (u Uploader) printRequest(req *http.Request, label string, size int64) {
+	if label != "" {
+		stderr("%s %s (%s)", req.Method, req.URL, label)
+	} else {
+		stderr("%s %s", req.Method, req.URL)
+	}
+	header := u.redactHeader(req.Header)
+	var keys []string
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		stderr("    %s: %s", k, strings.Join(header[k], ", "))
+	}
+	if size >= 0 {
+		stderr("    body size: %d bytes", size)
+	} else {
+		stderr("    body size: unknown")
+	}
+}
+
+// printCurl prints a curl command equivalent to req with the given body. The
+// body is not consumed.
+func (u Uploader) printCurl(req *http.Request, body io.Reader) error {
+	args := []string{"curl", "-X", req.Method}
+	header := u.redactHeader(req.Header)
+	var keys []string
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			args = append(args, "-H", shellQuote(k+": "+v))
+		}
+	}
+	switch b := body.(type) {
+	case *os.File:
+		args = append(args, "--upload-file", shellQuote(b.Name()))
+	case *bytes.Reader:
+		data, err := ioutil.ReadAll(b)
+		if err != nil {
+			return err
+		}
+		if _, err := b.Seek(0, 0); err != nil {
+			return err
+		}
+		args = append(args, "--data-binary", shellQuote(string(data)))
+	}
+	args = append(args, shellQuote(req.URL.String()))
+	stderr("%s", strings.Join(args, " "))
+	return nil
+}
+
+// dumpManifest prints the manifest as indented JSON.
+func dumpManifest(manifest *schema.ImageManifest) error {
+	blob, err := manifest.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, blob, "", "\t"); err != nil {
+		return err
+	}
+	stderr("%s", out.String())
+	return nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
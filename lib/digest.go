@@ -0,0 +1,191 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/aci"
+)
+
+// partNames are the names accepted in DigestParts.
+var partNames = []string{"manifest", "signature", "aci"}
+
+// digestPlaceholder is substituted with the image ID in the push endpoint of
+// a content-addressable push.
+const digestPlaceholder = "{digest}"
+
+// digestParts returns the set of parts to send a digest for, by lower case
+// label.
+func (u Uploader) digestParts() (map[string]bool, error) {
+	if !u.SendDigest {
+		return nil, nil
+	}
+	names := u.DigestParts
+	if len(names) == 0 {
+		names = partNames
+	}
+	parts := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(name)
+		valid := false
+		for _, n := range partNames {
+			valid = valid || n == name
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown part %q, expected one of %s", name, strings.Join(partNames, ", "))
+		}
+		parts[name] = true
+	}
+	return parts, nil
+}
+
+// digestHeader returns the Digest header to send along with the part, which
+// has to be rewindable to be digested before being sent. A nil header is
+// returned for parts whose body is streamed.
+func (u Uploader) digestHeader(part partToUpload) (http.Header, error) {
+	rs, ok := part.r.(io.ReadSeeker)
+	if !ok {
+		u.warnf("not sending a digest of the %s, it is streamed", part.label)
+		return nil, nil
+	}
+	offset, err := rs.Seek(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		return nil, err
+	}
+	if _, err := rs.Seek(offset, 0); err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	return header, nil
+}
+
+// sendDigestTrailer makes the request send the SHA-256 digest of its body in
+// a Digest trailer, computed while the body is sent, starting over if the
+// body is sent again.
+func sendDigestTrailer(req *http.Request) {
+	if req.Body == nil {
+		return
+	}
+	req.Trailer = http.Header{"Digest": nil}
+	// Trailers are only sent with chunked bodies.
+	req.ContentLength = -1
+	wrap := func(rc io.ReadCloser) io.ReadCloser {
+		return &trailerDigester{rc, sha256.New(), req.Trailer}
+	}
+	req.Body = wrap(req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			rc, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return wrap(rc), nil
+		}
+	}
+}
+
+// trailerDigester digests the body it reads, and sets the Digest trailer
+// once it is read whole.
+type trailerDigester struct {
+	rc      io.ReadCloser
+	h       hash.Hash
+	trailer http.Header
+}
+
+func (d *trailerDigester) Read(p []byte) (int, error) {
+	n, err := d.rc.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF {
+		d.trailer.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(d.h.Sum(nil)))
+	}
+	return n, err
+}
+
+func (d *trailerDigester) Close() error {
+	return d.rc.Close()
+}
+
+// imageID returns the image ID of the image file, which is the SHA-512
+// digest of its uncompressed tar.
+func (u Uploader) imageID() (string, error) {
+	if u.Streaming && u.Acipath == "-" {
+		return "", fmt.Errorf("a content-addressable push needs an image file, not stdin")
+	}
+	f, err := os.Open(u.Acipath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if finfo.IsDir() {
+		return "", fmt.Errorf("a content-addressable push needs an image file, %s is a directory", u.Acipath)
+	}
+	r, err := aci.NewCompressedReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("error computing the image ID: %v", err)
+	}
+	return "sha512-" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// expandDigest substitutes the image ID, if any, into the push endpoint.
+func expandDigest(url, digest string) string {
+	if digest == "" {
+		return url
+	}
+	return strings.Replace(url, digestPlaceholder, digest, -1)
+}
+
+// fileDigest returns the SHA-256 digest of the image, in the format of
+// byteMeter.digest, reading it from the start and seeking back there.
+func fileDigest(image io.Reader) (string, error) {
+	f, ok := image.(*os.File)
+	if !ok {
+		return "", fmt.Errorf("verifying the digest of the ACI streamed needs it to be sent as is from a file")
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+	m := newByteMeter(true)
+	if _, err := io.Copy(m, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+	return m.digest(), nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/aci"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+)
+
+// FormatACIDir is the format of unpacked ACI directories, holding the
+// manifest file and the rootfs directory, which are archived while
+// uploading them.
+const FormatACIDir = "acidir"
+
+// tarArchiveWriter writes the files of an ACI layout as they are walked.
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (w tarArchiveWriter) AddFile(hdr *tar.Header, r io.Reader) error {
+	if err := w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if r == nil {
+		return nil
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// openACIDir reads the manifest of the ACI layout at dir and returns it
+// along with a reader of the ACI built from the layout, as a tar archive.
+func openACIDir(dir string) (*schema.ImageManifest, io.ReadCloser, error) {
+	path := filepath.Join(dir, aci.ManifestFile)
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest := &schema.ImageManifest{}
+	if err := manifest.UnmarshalJSON(blob); err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return manifest, buildACI(dir, finfo, blob), nil
+}
+
+// buildACI streams a tar archive of the ACI layout at dir. The manifest is
+// written first, with the metadata of its file, so that the archive is the
+// same for the same layout.
+func buildACI(dir string, manifestInfo os.FileInfo, manifest []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		hdr, err := tar.FileInfoHeader(manifestInfo, "")
+		if err == nil {
+			hdr.Name = aci.ManifestFile
+			hdr.Size = int64(len(manifest))
+			err = tw.WriteHeader(hdr)
+		}
+		if err == nil {
+			_, err = tw.Write(manifest)
+		}
+		if err == nil {
+			// The walker skips the manifest, which was written
+			// already.
+			err = filepath.Walk(dir, aci.BuildWalker(dir, tarArchiveWriter{tw}, nil))
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,307 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/discovery"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema/types"
+)
+
+var errEnoughEndpoints = errors.New("enough discovery information found")
+
+// discoveryClientMu guards the transport of discovery.Client, which is
+// swapped while tracing discovery, resolving with a custom resolver, going
+// through a given proxy or checking certificate pins. Such walks hold it
+// exclusively, the others share it.
+var discoveryClientMu sync.RWMutex
+
+// DiscoverPushEndpoints performs meta discovery for the given image name and
+// returns all push endpoints found, in the order they were discovered.
+func DiscoverPushEndpoints(uri string, insecure bool) ([]string, error) {
+	eps, _, err := DiscoverPushEndpointsWithAttempts(uri, insecure)
+	return eps, err
+}
+
+// DiscoverPushEndpointsWithAttempts works like DiscoverPushEndpoints, but
+// also returns the failed discovery attempts, for debugging and user
+// feedback.
+func DiscoverPushEndpointsWithAttempts(uri string, insecure bool) ([]string, []discovery.FailedAttempt, error) {
+	app, err := discovery.NewAppFromString(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	return Uploader{Insecure: insecure}.discoverPushEndpoints(app)
+}
+
+// DiscoveryError is returned when meta discovery finds no push endpoint.
+type DiscoveryError struct {
+	// Name is the image name discovery was performed for.
+	Name string
+	// Attempts are the fetches that failed, for each prefix of Name
+	// with no discovery page.
+	Attempts []discovery.FailedAttempt
+	// Hints are the likely causes of the failure, as guessed from the
+	// attempts.
+	Hints []string
+}
+
+func (e *DiscoveryError) Error() string {
+	msg := fmt.Sprintf("no endpoints discovered for %s", e.Name)
+	if len(e.Attempts) != 0 {
+		var tried []string
+		for _, a := range e.Attempts {
+			tried = append(tried, fmt.Sprintf("%s (%v)", a.Prefix, a.Error))
+		}
+		msg = fmt.Sprintf("%s, tried: %s", msg, strings.Join(tried, "; "))
+	}
+	for _, hint := range e.Hints {
+		msg += "\n  hint: " + hint
+	}
+	return msg
+}
+
+// discoveryHints guesses the likely causes of a failed discovery from its
+// attempts.
+func (u Uploader) discoveryHints(e *DiscoveryError) []string {
+	host := strings.SplitN(e.Name, "/", 2)[0]
+	prefixes := strings.Count(e.Name, "/") + 1
+	if len(e.Attempts) < prefixes {
+		return []string{fmt.Sprintf("discovery pages were found, but without an ac-push-discovery meta tag: is push discovery configured on %s?", host)}
+	}
+
+	var hints []string
+	statuses := make(map[string]int)
+	unreachable, unresolved := 0, 0
+	for _, a := range e.Attempts {
+		msg := a.Error.Error()
+		switch {
+		case strings.HasPrefix(msg, "expected a 200 OK got "):
+			statuses[strings.TrimPrefix(msg, "expected a 200 OK got ")]++
+		case strings.Contains(msg, "no such host"):
+			unresolved++
+		default:
+			unreachable++
+		}
+	}
+	switch {
+	case statuses["404"] == len(e.Attempts):
+		hints = append(hints, fmt.Sprintf("all hosts returned HTTP 404: is meta discovery configured on %s, and is the image name spelled right?", host))
+	case statuses["401"]+statuses["403"] == len(e.Attempts):
+		hints = append(hints, fmt.Sprintf("all hosts refused access: %s may need credentials for discovery", host))
+	}
+	if unresolved != 0 {
+		hints = append(hints, fmt.Sprintf("%s could not be resolved: is the image name spelled right?", host))
+	}
+	if unreachable != 0 && !u.Insecure {
+		hints = append(hints, fmt.Sprintf("the https requests failed: if %s only serves http, --insecure is needed", host))
+	}
+	return hints
+}
+
+// DiscoveredEndpoint is a push endpoint found by meta discovery.
+type DiscoveredEndpoint struct {
+	// Template is the endpoint as found in the ac-push-discovery meta
+	// tag, with only the image name substituted.
+	Template string
+	// URL is the endpoint with the labels of the image name substituted
+	// too. It still holds the placeholders of unknown labels.
+	URL string
+}
+
+// DiscoverPushTemplates performs meta discovery for Uri and returns the push
+// endpoints found, without opening the image unless Uri is empty. Only the
+// labels of Uri and of the configured defaults are known, not the ones found
+// in the image.
+func (u Uploader) DiscoverPushTemplates() ([]DiscoveredEndpoint, error) {
+	u, err := u.withURI()
+	if err != nil {
+		return nil, err
+	}
+	app, err := discovery.NewAppFromString(u.rewrittenURI())
+	if err != nil {
+		return nil, err
+	}
+	if u.Repository != "" {
+		if err := overrideRepository(app, u.Repository); err != nil {
+			return nil, err
+		}
+	}
+	if defaults, ok := u.findDefaults(app); ok {
+		for name, value := range defaults.Labels {
+			if _, ok := app.Labels[types.ACIdentifier(name)]; !ok {
+				app.Labels[types.ACIdentifier(name)] = value
+			}
+		}
+	}
+	if app.Labels["version"] == "" {
+		app.Labels["version"] = "latest"
+	}
+
+	// Discovery is performed with every label set to its own
+	// placeholder, so that the endpoints come back unexpanded.
+	tplApp := app.Copy()
+	for name := range tplApp.Labels {
+		tplApp.Labels[name] = fmt.Sprintf("{%s}", name)
+	}
+	eps, _, err := u.discoverPushEndpoints(tplApp)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]DiscoveredEndpoint, len(eps))
+	for i, ep := range eps {
+		url := ep
+		for name, value := range app.Labels {
+			url = strings.Replace(url, fmt.Sprintf("{%s}", name), value, -1)
+		}
+		found[i] = DiscoveredEndpoint{Template: ep, URL: url}
+	}
+	return found, nil
+}
+
+// discoverPushEndpoints performs meta discovery for the app and returns the
+// push endpoints found, of which there is at least one if err is nil.
+func (u Uploader) discoverPushEndpoints(app *discovery.App) ([]string, []discovery.FailedAttempt, error) {
+	if u.Debug {
+		stderr("searching for push endpoint via meta discovery")
+	}
+	eps, attempts, err := u.discoverEndpoints(app)
+	if u.Debug && !u.TraceDiscovery {
+		for _, a := range attempts {
+			stderr("meta tag 'ac-push-discovery' not found on %s: %v", a.Prefix, a.Error)
+		}
+	}
+	// The walk returns the error of the last prefix, which is among
+	// the attempts, when no discovery page was found for it.
+	if err != nil || len(eps.ACIPushEndpoints) == 0 {
+		return nil, attempts, &DiscoveryError{Name: app.Name.String(), Attempts: attempts}
+	}
+	return eps.ACIPushEndpoints, attempts, nil
+}
+
+// discoverEndpoints performs meta discovery for the app, tracing it if
+// TraceDiscovery is set.
+func (u Uploader) discoverEndpoints(app *discovery.App) (*discovery.Endpoints, []discovery.FailedAttempt, error) {
+	if !u.TraceDiscovery && u.Resolver == "" && !u.proxied() && len(u.CertPins) == 0 {
+		discoveryClientMu.RLock()
+		defer discoveryClientMu.RUnlock()
+		return discovery.DiscoverEndpoints(*app, u.Insecure)
+	}
+
+	// The discovery package performs its requests with discovery.Client,
+	// so its transport is replaced for the duration of the walk.
+	discoveryClientMu.Lock()
+	defer discoveryClientMu.Unlock()
+	rt := discovery.Client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	discovery.Client.Transport = u.discoveryTransport(rt)
+	defer func() { discovery.Client.Transport = rt }()
+
+	if u.TraceDiscovery {
+		return traceDiscoverEndpoints(*app, u.Insecure)
+	}
+	return discovery.DiscoverEndpoints(*app, u.Insecure)
+}
+
+// discoveryTransport wraps the transport of discovery.Client to resolve
+// names with Resolver, to go through Proxy, to check CertPins and to trace
+// the fetches, as configured.
+func (u Uploader) discoveryTransport(rt http.RoundTripper) http.RoundTripper {
+	if t, ok := rt.(*http.Transport); ok && (u.Resolver != "" || u.proxied() || len(u.CertPins) != 0) {
+		t = t.Clone()
+		if u.Resolver != "" {
+			t.DialContext = u.dialContext()
+		}
+		if u.proxied() {
+			t.Proxy = u.proxy
+		}
+		if len(u.CertPins) != 0 {
+			c := &tls.Config{}
+			if t.TLSClientConfig != nil {
+				c = t.TLSClientConfig.Clone()
+			}
+			c.VerifyPeerCertificate = u.verifyCertPins
+			t.TLSClientConfig = c
+		}
+		rt = t
+	}
+	if u.TraceDiscovery {
+		rt = &traceTransport{rt}
+	}
+	return rt
+}
+
+// traceTransport logs every meta discovery fetch along with its result.
+type traceTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.rt.RoundTrip(req)
+	if err != nil {
+		stderr("discovery: %s %s: %v", req.Method, req.URL, err)
+		return nil, err
+	}
+	stderr("discovery: %s %s: %s", req.Method, req.URL, res.Status)
+	return res, nil
+}
+
+// traceDiscoverEndpoints works like discovery.DiscoverEndpoints, but logs
+// every fetch attempt and what was found for every prefix walked.
+// The fetches are logged by the transport of discovery.Client, which must be
+// wrapped in a traceTransport.
+func traceDiscoverEndpoints(app discovery.App, insecure bool) (*discovery.Endpoints, []discovery.FailedAttempt, error) {
+	var (
+		out      = &discovery.Endpoints{}
+		attempts []discovery.FailedAttempt
+		prefixes []string
+	)
+	walkFn := func(prefix string, eps *discovery.Endpoints, err error) error {
+		prefixes = append(prefixes, prefix)
+		if err != nil {
+			stderr("discovery: prefix %s: %v", prefix, err)
+			attempts = append(attempts, discovery.FailedAttempt{Prefix: prefix, Error: err})
+			return nil
+		}
+		if len(eps.ACIPushEndpoints) == 0 {
+			stderr("discovery: prefix %s: meta tag 'ac-push-discovery' not found", prefix)
+		}
+		for _, ep := range eps.ACIPushEndpoints {
+			stderr("discovery: prefix %s: meta tag 'ac-push-discovery' found, expanded to %s", prefix, ep)
+		}
+		out.Append(*eps)
+		if len(out.ACIEndpoints) != 0 || len(out.Keys) != 0 || len(out.ACIPushEndpoints) != 0 {
+			return errEnoughEndpoints
+		}
+		return nil
+	}
+
+	err := discovery.DiscoverWalk(app, insecure, walkFn)
+	if err != nil && err != errEnoughEndpoints {
+		return nil, attempts, err
+	}
+	if len(out.ACIPushEndpoints) == 0 {
+		stderr("discovery: no push endpoints found, tried prefixes: %s", strings.Join(prefixes, ", "))
+	}
+	return out, attempts, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/discovery"
+)
+
+// discoveryCacheEntry holds the push endpoints discovered for an image name.
+type discoveryCacheEntry struct {
+	// Templates are the endpoints found, with the name substituted but
+	// the labels left as placeholders, so that they hold for every
+	// version of the image.
+	Templates []string `json:"templates"`
+	// Insecure is set when the endpoints were discovered with Insecure,
+	// possibly over plain http.
+	Insecure bool      `json:"insecure,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// discoveryCache maps image names to the push endpoints discovered for them.
+type discoveryCache map[string]discoveryCacheEntry
+
+// discoveryCacheMu serializes the updates of the discovery cache by the
+// pushes of UploadMirror.
+var discoveryCacheMu sync.Mutex
+
+func readDiscoveryCache(path string) (discoveryCache, error) {
+	cache := make(discoveryCache)
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, &cache); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return cache, nil
+}
+
+func writeDiscoveryCache(path string, cache discoveryCache) error {
+	blob, err := json.MarshalIndent(cache, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(blob, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// discoveryCached returns whether discovery results are read from and
+// saved to the DiscoveryCacheFile.
+func (u Uploader) discoveryCached() bool {
+	return u.DiscoveryCacheFile != "" && u.DiscoveryCacheTTL > 0 && !u.TraceDiscovery
+}
+
+// cachedPushEndpoints works like discoverPushEndpoints, but returns the
+// endpoints of the discovery cache for the app's name unless they expired,
+// and saves the ones discovered otherwise.
+func (u Uploader) cachedPushEndpoints(app *discovery.App) ([]string, []discovery.FailedAttempt, error) {
+	app = app.Copy()
+	if app.Labels["version"] == "" {
+		app.Labels["version"] = "latest"
+	}
+	name := app.Name.String()
+
+	discoveryCacheMu.Lock()
+	cache, err := readDiscoveryCache(u.DiscoveryCacheFile)
+	discoveryCacheMu.Unlock()
+	if err != nil {
+		u.warnf("ignoring the discovery cache: %v", err)
+	}
+	// Endpoints discovered with Insecure aren't trusted without it.
+	if e, ok := cache[name]; ok && time.Now().Before(e.Expires) && (!e.Insecure || u.Insecure) {
+		if u.Debug {
+			stderr("push endpoints of %s found in the discovery cache", name)
+		}
+		return expandTemplates(e.Templates, app), nil, nil
+	}
+
+	// Discovery is performed with every label set to its own
+	// placeholder, for the endpoints to be saved unexpanded.
+	tplApp := app.Copy()
+	for label := range tplApp.Labels {
+		tplApp.Labels[label] = fmt.Sprintf("{%s}", label)
+	}
+	tpls, attempts, err := u.discoverPushEndpoints(tplApp)
+	if err != nil {
+		return nil, attempts, err
+	}
+	u.updateDiscoveryCache(func(cache discoveryCache) {
+		cache[name] = discoveryCacheEntry{
+			Templates: tpls,
+			Insecure:  u.Insecure,
+			Expires:   time.Now().Add(u.DiscoveryCacheTTL),
+		}
+	})
+	return expandTemplates(tpls, app), attempts, nil
+}
+
+// forgetDiscovery removes the endpoints of the app's name from the
+// discovery cache.
+func (u Uploader) forgetDiscovery(app *discovery.App) {
+	if u.Debug {
+		stderr("removing the push endpoints of %s from the discovery cache", app.Name)
+	}
+	u.updateDiscoveryCache(func(cache discoveryCache) {
+		delete(cache, app.Name.String())
+	})
+}
+
+// updateDiscoveryCache applies update to the discovery cache, dropping its
+// expired entries. Failures only cost discoveries, so they are warned
+// about.
+func (u Uploader) updateDiscoveryCache(update func(discoveryCache)) {
+	discoveryCacheMu.Lock()
+	defer discoveryCacheMu.Unlock()
+	cache, err := readDiscoveryCache(u.DiscoveryCacheFile)
+	if err != nil {
+		cache = make(discoveryCache)
+	}
+	now := time.Now()
+	for name, e := range cache {
+		if !now.Before(e.Expires) {
+			delete(cache, name)
+		}
+	}
+	update(cache)
+	if err := writeDiscoveryCache(u.DiscoveryCacheFile, cache); err != nil {
+		u.warnf("error saving the discovery cache: %v", err)
+	}
+}
+
+// expandTemplates substitutes the app's labels into the endpoint templates.
+func expandTemplates(tpls []string, app *discovery.App) []string {
+	eps := make([]string, len(tpls))
+	for i, tpl := range tpls {
+		ep := tpl
+		for name, value := range app.Labels {
+			ep = strings.Replace(ep, fmt.Sprintf("{%s}", name), value, -1)
+		}
+		eps[i] = ep
+	}
+	return eps
+}
+
+// isConnectionError returns whether err tells that a request couldn't reach
+// its server.
+func isConnectionError(err error) bool {
+	uerr, ok := err.(*url.Error)
+	if !ok {
+		return false
+	}
+	_, ok = uerr.Err.(*net.OpError)
+	return ok
+}
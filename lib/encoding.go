@@ -0,0 +1,108 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// acceptEncoding is requested explicitly for the JSON replies of the
+// server, which are then decoded by decodeBody rather than by the
+// transport.
+const acceptEncoding = "gzip, deflate"
+
+// withAcceptEncoding returns a copy of header requesting compressed
+// replies.
+func withAcceptEncoding(header http.Header) http.Header {
+	h := make(http.Header)
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Set("Accept-Encoding", acceptEncoding)
+	return h
+}
+
+// gzipEncodeBody makes the body of the request be sent gzip compressed at
+// the given level, with a Content-Encoding telling the server to decode it,
+// starting over if the body is sent again. The size of the encoded body
+// isn't known in advance, so it is sent chunked.
+func gzipEncodeBody(req *http.Request, level int) {
+	if req.Body == nil {
+		return
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	req.ContentLength = -1
+	wrap := func(rc io.ReadCloser) io.ReadCloser {
+		// Closing the encoded stream stops the compression of the
+		// rest of the body, if the request fails before sending it.
+		gz := gzipStream(rc, level)
+		return &closingBody{gz, []io.Closer{gz, rc}}
+	}
+	req.Body = wrap(req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			rc, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return wrap(rc), nil
+		}
+	}
+}
+
+// closingBody reads a body, and closes all of the readers it is read
+// through.
+type closingBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *closingBody) Close() error {
+	var err error
+	for _, c := range b.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// decodeBody returns the body of the response, decompressed according to
+// its Content-Encoding.
+func decodeBody(res *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return res.Body, nil
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding gzip response: %v", err)
+		}
+		return &closingBody{gr, []io.Closer{gr, res.Body}}, nil
+	case "deflate":
+		zr, err := zlib.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding deflate response: %v", err)
+		}
+		return &closingBody{zr, []io.Closer{zr, res.Body}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported response encoding: %q", res.Header.Get("Content-Encoding"))
+	}
+}
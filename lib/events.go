@@ -0,0 +1,135 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// UploadEventKind is the kind of an UploadEvent.
+type UploadEventKind int
+
+const (
+	// DiscoveryStarted is sent when meta discovery of the push endpoint
+	// starts.
+	DiscoveryStarted UploadEventKind = iota
+	// EndpointResolved is sent once the initiation URL is known.
+	EndpointResolved
+	// InitiationComplete is sent once the upload is initiated.
+	InitiationComplete
+	// PartStarted, PartProgress and PartComplete are sent when the upload
+	// of a part starts, as its bytes are sent, and once it is uploaded.
+	PartStarted
+	PartProgress
+	PartComplete
+	// CompletionComplete is sent once the server accepted the completion
+	// of the push.
+	CompletionComplete
+)
+
+var eventKindNames = [...]string{
+	DiscoveryStarted:   "DiscoveryStarted",
+	EndpointResolved:   "EndpointResolved",
+	InitiationComplete: "InitiationComplete",
+	PartStarted:        "PartStarted",
+	PartProgress:       "PartProgress",
+	PartComplete:       "PartComplete",
+	CompletionComplete: "CompletionComplete",
+}
+
+func (k UploadEventKind) String() string {
+	if k < 0 || int(k) >= len(eventKindNames) {
+		return fmt.Sprintf("UploadEventKind(%d)", int(k))
+	}
+	return eventKindNames[k]
+}
+
+// UploadEvent is a step of a push, sent to Events.
+type UploadEvent struct {
+	Kind UploadEventKind
+	// URI is the image pushed, telling the pushes of UploadMirror apart.
+	URI string
+	// URL is the URL the step is about: the initiation URL, the URL of a
+	// part or the completion URL.
+	URL string
+	// Part is the label of the part of the part events: "manifest",
+	// "signature" or "ACI".
+	Part string
+	// Sent is the number of bytes of the part sent so far, and Size the
+	// size of the part, -1 if it isn't known in advance.
+	Sent int64
+	Size int64
+}
+
+// progressEventInterval is the least time between the PartProgress events
+// of a part.
+const progressEventInterval = 100 * time.Millisecond
+
+// sendEvent sends the event of the push to Events, if set.
+func (u Uploader) sendEvent(e UploadEvent) {
+	if u.Events == nil {
+		return
+	}
+	e.URI = u.Uri
+	u.Events <- e
+}
+
+// partProgress counts the bytes of the part being uploaded, sending
+// PartProgress events as they are sent.
+type partProgress struct {
+	u     Uploader
+	event UploadEvent
+	last  time.Time
+}
+
+func (p *partProgress) Write(b []byte) (int, error) {
+	p.event.Sent += int64(len(b))
+	if now := time.Now(); now.Sub(p.last) >= progressEventInterval {
+		p.last = now
+		p.u.sendEvent(p.event)
+	}
+	return len(b), nil
+}
+
+// reportProgress makes the body of the request be counted by the progress
+// of the part being uploaded, starting over where it started if the body is
+// sent again.
+func (u Uploader) reportProgress(req *http.Request) {
+	p := u.progress
+	if p == nil || req.Body == nil {
+		return
+	}
+	start := p.event.Sent
+	wrap := func(rc io.ReadCloser) io.ReadCloser {
+		p.event.Sent = start
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(rc, p), rc}
+	}
+	req.Body = wrap(req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return wrap(body), nil
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/aci"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/discovery"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+)
+
+// extLabel returns the ext label of the image, without its leading dot,
+// from Ext if set, or else from the image format and compression.
+func (u Uploader) extLabel(compressed bool) (string, error) {
+	if u.Ext != "" {
+		ext := strings.TrimPrefix(u.Ext, ".")
+		if ext == "" || strings.ContainsAny(ext, "/,") {
+			return "", fmt.Errorf("invalid ext label: %q", u.Ext)
+		}
+		return ext, nil
+	}
+	ext := strings.Trim(schema.ACIExtension, ".")
+	if u.Format == FormatOCI {
+		ext = ociExtension
+	}
+	if compressed {
+		ext += ".gz"
+	}
+	return ext, nil
+}
+
+// checkExt warns if the ext label of the app names a compression other than
+// the one of the ACI uploaded, as the registries storing the images under
+// their ext would then serve them with the wrong one.
+func (u Uploader) checkExt(app *discovery.App, image io.Reader, compressed bool) {
+	ext, ok := app.Labels[extLabelName]
+	if !ok || (u.Format != "" && u.Format != FormatACI) {
+		return
+	}
+	var named aci.FileType
+	for _, typ := range []aci.FileType{aci.TypeGzip, aci.TypeBzip2, aci.TypeXz} {
+		if strings.HasSuffix(ext, "."+string(typ)) {
+			named = typ
+		}
+	}
+
+	typ := aci.TypeGzip
+	switch image := image.(type) {
+	case *streamedImage:
+		if !compressed {
+			typ = image.typ
+		}
+	case *os.File:
+		if !compressed {
+			var err error
+			if typ, err = aci.DetectFileType(image); err != nil {
+				return
+			}
+			if _, err := image.Seek(0, 0); err != nil {
+				return
+			}
+		}
+	default:
+		if !compressed {
+			return
+		}
+	}
+
+	// Compressed ACIs are commonly pushed with the aci ext, which names
+	// no compression.
+	switch {
+	case named == "" || named == typ:
+	case typ == aci.TypeTar:
+		u.warnf("the ext label %q names a %s compressed image, but the image isn't compressed", ext, compressionNames[named])
+	default:
+		u.warnf("the ext label %q names a %s compressed image, but the image is %s compressed", ext, compressionNames[named], compressionNames[typ])
+	}
+}
+
+// compressionNames are the names of the compressions of the ACIs, by file
+// type.
+var compressionNames = map[aci.FileType]string{
+	aci.TypeGzip:  "gzip",
+	aci.TypeBzip2: "bzip2",
+	aci.TypeXz:    "xz",
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// idempotencyHeader carries the key identifying the push on the initiation
+// and completion requests, for servers to recognize retries.
+const idempotencyHeader = "Idempotency-Key"
+
+// newIdempotencyKey returns a random (version 4) UUID.
+func newIdempotencyKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("error generating the idempotency key: %v", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// withIdempotencyKey adds the idempotency key of the push, if any, to the
+// header, creating it if needed.
+func (u Uploader) withIdempotencyKey(header http.Header) http.Header {
+	if header == nil {
+		header = make(http.Header)
+	}
+	if u.idempotencyKey != "" {
+		header.Set(idempotencyHeader, u.idempotencyKey)
+	}
+	return header
+}
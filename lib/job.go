@@ -0,0 +1,92 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	jobPollInterval = 2 * time.Second
+
+	jobStatusDone   = "done"
+	jobStatusFailed = "failed"
+)
+
+// jobStatus is the reply of the server when polling an asynchronous job.
+type jobStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// pollJob polls the job's URL until the server reports it as done or failed,
+// or until CompletionPollTimeout elapses.
+func (u Uploader) pollJob(id, url string) error {
+	if id == "" {
+		id = url
+	}
+	var deadline time.Time
+	if u.CompletionPollTimeout > 0 {
+		deadline = time.Now().Add(u.CompletionPollTimeout)
+	}
+
+	lastStatus := ""
+	for {
+		status, err := u.getJobStatus(url)
+		if err != nil {
+			return fmt.Errorf("error polling job %s: %v", id, err)
+		}
+		if u.Debug && status.Status != lastStatus {
+			stderr("job %s: %s", id, status.Status)
+		}
+		lastStatus = status.Status
+
+		switch status.Status {
+		case jobStatusDone:
+			return nil
+		case jobStatusFailed:
+			return fmt.Errorf("job %s failed: %s", id, status.Reason)
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("job %s still %s after %v", id, status.Status, u.CompletionPollTimeout)
+		}
+		if err := u.sleep(jobPollInterval); err != nil {
+			return fmt.Errorf("job %s still %s: %v", id, status.Status, err)
+		}
+	}
+}
+
+func (u Uploader) getJobStatus(url string) (*jobStatus, error) {
+	resp, err := u.performRequest("GET", url, withAcceptEncoding(nil), nil, false, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	respblob, err := ioutil.ReadAll(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &jobStatus{}
+	if err := json.Unmarshal(respblob, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
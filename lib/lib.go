@@ -16,19 +16,25 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/aci"
 	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/discovery"
 	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema/types"
 	"github.com/appc/acpush/Godeps/_workspace/src/github.com/coreos/ioprogress"
 )
 
@@ -36,168 +42,1566 @@ const (
 	archLabelName = "arch"
 	osLabelName   = "os"
 	extLabelName  = "ext"
+
+	annotationHeaderPrefix = "X-ACPush-Annotation-"
 )
 
-type initiateDetails struct {
-	ACIPushVersion string `json:"aci_push_version"`
-	Multipart      bool   `json:"multipart"`
-	ManifestURL    string `json:"upload_manifest_url"`
-	SignatureURL   string `json:"upload_signature_url"`
-	ACIURL         string `json:"upload_aci_url"`
-	CompletedURL   string `json:"completed_url"`
-}
+type initiateDetails struct {
+	ACIPushVersion string `json:"aci_push_version"`
+	Multipart      bool   `json:"multipart"`
+	ManifestURL    string `json:"upload_manifest_url"`
+	SignatureURL   string `json:"upload_signature_url"`
+	ACIURL         string `json:"upload_aci_url"`
+	CompletedURL   string `json:"completed_url"`
+	// MinACVersion and MaxACVersion optionally bound the acVersion of
+	// the manifests accepted by the server.
+	MinACVersion string `json:"min_ac_version,omitempty"`
+	MaxACVersion string `json:"max_ac_version,omitempty"`
+	// PartOrder optionally lists the order in which the server wants
+	// the parts ("manifest", "signature" and "aci") to be uploaded.
+	PartOrder []string `json:"part_order,omitempty"`
+	// UploadProtocol optionally selects how the parts are uploaded:
+	// with a PUT request to each part URL by default, or with the tus
+	// resumable upload protocol if "tus".
+	UploadProtocol string `json:"upload_protocol,omitempty"`
+	// ManifestInlined is set by servers which took the manifest from the
+	// initiation request, for which the manifest part isn't uploaded.
+	ManifestInlined bool `json:"manifest_inlined,omitempty"`
+	// NoCompletion is set by servers which complete the push on their
+	// own once the last part is uploaded, closing the connection, and
+	// which take no completion request then.
+	NoCompletion bool `json:"no_completion,omitempty"`
+}
+
+// resolveURLs resolves the URLs of the initiation response against the
+// initiation URL, for servers returning relative ones.
+func (d *initiateDetails) resolveURLs(initurl string) error {
+	base, err := url.Parse(initurl)
+	if err != nil {
+		return err
+	}
+	for _, p := range []*string{&d.ManifestURL, &d.SignatureURL, &d.ACIURL, &d.CompletedURL} {
+		if *p == "" {
+			continue
+		}
+		ref, err := url.Parse(*p)
+		if err != nil {
+			return fmt.Errorf("invalid URL in the initiation response: %v", err)
+		}
+		*p = base.ResolveReference(ref).String()
+	}
+	return nil
+}
+
+// initiateBody is sent with the initiation request with InitiationBody,
+// for servers to reject or prepare for the upload early.
+type initiateBody struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Size   int64             `json:"size,omitempty"`
+	// Manifest is the image manifest, sent with InlineManifest.
+	Manifest json.RawMessage `json:"manifest,omitempty"`
+}
+
+// completionReply is what the response to the completion of a successful
+// push tells of it.
+type completionReply struct {
+	etag    string
+	message string
+}
+
+type completeMsg struct {
+	Success      bool   `json:"success"`
+	Reason       string `json:"reason,omitempty"`
+	ServerReason string `json:"server_reason,omitempty"`
+	// JobID and JobURL are set by servers that process the image
+	// asynchronously after the completion. The job's status is then
+	// polled from JobURL.
+	JobID  string `json:"job_id,omitempty"`
+	JobURL string `json:"job_url,omitempty"`
+	// FailedPart and BytesSent are set when reporting the failed upload
+	// of a part, for the server to discard what it received of it.
+	FailedPart string `json:"failed_part,omitempty"`
+	BytesSent  *int64 `json:"bytes_sent,omitempty"`
+}
+
+// PushDefaults holds the push endpoint and labels to use by default for
+// images whose name starts with a given prefix.
+type PushDefaults struct {
+	// Endpoint is a push endpoint template, in the same format as the
+	// one found in the ac-push-discovery meta tag. If empty, meta
+	// discovery is performed.
+	Endpoint string
+	// Labels are applied to the image name if not already specified
+	// in the Uri.
+	Labels map[string]string
+}
+
+func stderr(format string, a ...interface{}) {
+	out := fmt.Sprintf(format, a...)
+	fmt.Fprintln(os.Stderr, strings.TrimSuffix(out, "\n"))
+}
+
+// Uploader holds information about an upload to be performed.
+//
+// Upload doesn't modify the Uploader, so the same one can be used by several
+// goroutines at once, as long as its fields aren't changed meanwhile and
+// SetHTTPHeaders, Interceptors, Credentials and Confirm are safe for
+// concurrent use. The lines written to Log are serialized.
+type Uploader struct {
+	Acipath  string
+	Ascpath  string
+	Uri      string
+	Insecure bool
+	Debug    bool
+
+	// Repository, if set, overrides the image name used for discovery,
+	// while the labels are still taken from the Uri and the manifest.
+	Repository string
+
+	// Endpoint, if set, is the push endpoint template to use instead of
+	// the configured defaults and meta discovery, in the same format as
+	// the one found in the ac-push-discovery meta tag. It may be a
+	// unix:// URL, such as unix:///run/registry.sock/push, for the
+	// requests to be sent to /push over the /run/registry.sock Unix
+	// socket.
+	Endpoint string
+
+	// URIRewriter, if set, transforms Uri before it is parsed, so that
+	// the rewritten one is used for discovery and labels alike.
+	URIRewriter func(string) string
+
+	// Format is the format of the image at Acipath, FormatACI, FormatOCI
+	// or FormatACIDir. Defaults to FormatACI.
+	Format string
+
+	// NoProgressWhenRedirected disables the progress bar for bodies
+	// sent again after a redirect.
+	NoProgressWhenRedirected bool
+
+	// MinACVersion and MaxACVersion bound the acVersion of the manifest
+	// of the images pushed. MaxACVersion defaults to the version of the
+	// spec acpush is built against.
+	MinACVersion string
+	MaxACVersion string
+
+	// DefaultArch and DefaultOS are used for the arch and os labels
+	// when they are specified neither in the Uri nor in the manifest.
+	DefaultArch string
+	DefaultOS   string
+
+	// NoAutoLabel disables deriving the arch, os and ext labels from the
+	// manifest, so that discovery uses the labels in Uri verbatim, apart
+	// from the RequiredLabels.
+	NoAutoLabel bool
+
+	// RequiredLabels are the names of additional labels needed for
+	// discovery, which are taken from the manifest if missing from Uri.
+	RequiredLabels []string
+	// Ext, if set, is the ext label of the image when missing from Uri,
+	// in place of the one derived from the image format and compression,
+	// for registries expecting another one. A warning is given if it
+	// names a compression, as aci.gz does, other than the one of the ACI.
+	Ext string
+	// LabelAnnotations maps the names of labels to the annotations they
+	// are read from when missing from both Uri and the manifest's labels,
+	// for manifests built by tools putting them among the annotations.
+	LabelAnnotations map[string]string
+
+	// Streaming makes the ACI be read as a stream, which needs not be
+	// seekable, so that it can be pushed from a pipe. Acipath may then be
+	// "-" for stdin. Only the start of the ACI, up to its manifest, is
+	// buffered; the manifest should thus be among its first entries.
+	Streaming bool
+	// SessionFile, if set, is where the session of uploads is saved as
+	// they go: the initiation response, the tus uploads of the parts and
+	// the parts uploaded, for Resume to continue them from another
+	// process.
+	SessionFile string
+	// Resume makes the push continue the session saved in SessionFile
+	// for Uri, if any, instead of initiating a new upload. The parts
+	// uploaded are skipped, and the tus uploads are continued from the
+	// offset reported by the server.
+	Resume bool
+
+	// TempDir is the directory the image is staged to when Acipath is
+	// "-" for stdin without Streaming, or an http or https URL to fetch
+	// it from. Defaults to the default directory for temporary files.
+	TempDir string
+
+	// Compress is the compression to apply to the image while
+	// uploading it, if it isn't compressed already. Only
+	// CompressionGzip is supported.
+	Compress string
+
+	// CompressLevel is the gzip compression level applied with Compress
+	// and ContentEncoding, from 1 (fastest) to 9 (smallest). Defaults to
+	// 6.
+	CompressLevel int
+
+	// ContentEncoding, if set, is the HTTP Content-Encoding the ACI part
+	// is sent with, compressing it on the wire only: the server is to
+	// decode it and store the ACI as it is in the file. This differs
+	// from Compress, which turns the ACI itself into a compressed one.
+	// Only CompressionGzip is supported, and it can't be combined with
+	// Compress.
+	ContentEncoding string
+
+	// TraceDiscovery enables logging of every meta discovery fetch and
+	// of what was found on each of them.
+	TraceDiscovery bool
+
+	// DumpManifest makes the manifest of the image be printed, as it was
+	// read and before labels are derived from it, to tell which labels
+	// and annotations the image carries.
+	DumpManifest bool
+
+	// PrintRequests causes the requests following the initiation of the
+	// upload to be printed instead of being sent.
+	PrintRequests bool
+
+	// PayloadSchema, if set, is the path of a JSON file holding the JSON
+	// schemas of the payloads sent to the server, as published by some
+	// servers, under its "initiation" and "completion" members. Their
+	// references are resolved against the whole file, so that other
+	// schemas can be shared under its "definitions" member. The
+	// initiation body and completion messages are checked against them
+	// before being sent, the push failing if they don't match.
+	PayloadSchema string
+
+	// Curl causes an equivalent curl command to be printed for every
+	// request sent.
+	Curl bool
+
+	// TraceTiming enables logging of the DNS, connect, TLS handshake and
+	// time to first byte durations of every request, including the ones
+	// sent for redirects.
+	TraceTiming bool
+
+	// VerifyAfterPush causes the image to be looked up via meta
+	// discovery after a successful push, retrying for up to
+	// VerifyTimeout until it is available.
+	VerifyAfterPush bool
+	VerifyTimeout   time.Duration
+
+	// CompletionPollTimeout limits how long to wait for asynchronous
+	// processing on the server after completing the upload. Zero means
+	// no limit.
+	CompletionPollTimeout time.Duration
+
+	// SendDigest makes the parts listed in DigestParts be sent with a
+	// Digest header holding their SHA-256 digest, for the server to check
+	// their integrity.
+	SendDigest bool
+
+	// DigestParts lists the parts to send a digest for with SendDigest,
+	// by case-insensitive name: manifest, signature or aci. Defaults to
+	// all of them.
+	DigestParts []string
+
+	// DigestTrailer makes the digests of SendDigest be sent in a Digest
+	// trailer, computed while the parts are sent, instead of a header
+	// needing them to be read beforehand. Streamed parts get a digest
+	// too. It needs servers reading trailers, and isn't supported with
+	// the tus protocol.
+	DigestTrailer bool
+
+	// ContentAddressable makes the image be pushed to a path derived from
+	// its image ID, the SHA-512 digest of its uncompressed tar, which is
+	// substituted into the {digest} placeholder of the push endpoint as
+	// "sha512-" followed by the hex digest.
+	ContentAddressable bool
+
+	// Jitter is the strategy randomizing the exponential backoff of the
+	// completion retries, so that many clients don't retry at once
+	// against a recovering server: JitterNone, JitterFull or JitterEqual.
+	// Defaults to JitterFull. The fixed intervals of the polls aren't
+	// randomized.
+	Jitter string
+
+	// NoOverwrite makes the ACI be uploaded with an If-None-Match: *
+	// header, so that servers supporting it reject the push if the image
+	// version already exists.
+	NoOverwrite bool
+
+	// ETags holds the ETags returned when the image was last pushed to
+	// some URIs. The ETag of Uri, if any, is sent in an If-Match header
+	// with the ACI, so that servers supporting it reject the push with
+	// ErrImageChanged if someone else pushed the image since.
+	ETags map[string]string
+	// RecordETag, if set, is called with the ETag of the completion
+	// response of every successful push that has one, for the next
+	// pushes to be made with it. The calls of concurrent pushes aren't
+	// serialized.
+	RecordETag func(uri, etag string)
+
+	// CompletionMessage, if set, is called with the message the server
+	// returns in the server_reason of its reply to the completion of a
+	// successful push, such as where the image can be fetched from.
+	CompletionMessage func(uri, message string)
+
+	// Timeout, if set, limits the time the requests of the upload may
+	// take altogether, from its initiation to its completion.
+	Timeout time.Duration
+
+	// PartTimeout, if set, limits the time the upload of each part may
+	// take. When Timeout is set as well, the stricter of the two applies.
+	PartTimeout time.Duration
+
+	// ReadBufferSize, if set, is the size of the buffer the files are
+	// read with while uploading them, instead of the transport reading
+	// them 32KiB at a time. Larger ones may help on high latency links.
+	ReadBufferSize int
+
+	// Mmap makes the files be mapped in memory to be uploaded, instead
+	// of being read, which may be faster for huge images. Files that
+	// can't be mapped, or platforms without support for it, fall back to
+	// reads.
+	Mmap bool
+
+	// RateLimit, if set, is the most bytes per second the parts are
+	// uploaded at, to every host not in HostRateLimits. HostRateLimits
+	// holds the limits of given hosts. The pushes of UploadMirror share
+	// the limit of each host.
+	RateLimit      int64
+	HostRateLimits map[string]int64
+	// MaxConnsPerHost, if set, is the most requests in flight at once to
+	// a host, across the pushes of UploadMirror. The others wait for one
+	// to finish rather than fail.
+	MaxConnsPerHost int
+
+	// CompletionRetries is the number of times the completion request is
+	// sent again when it fails transiently, because the server can't be
+	// reached or replies with a 5xx or 429 status, waiting longer between
+	// each. It is independent of the other retries, as completing again
+	// is cheap and, with the idempotency key, safe.
+	CompletionRetries int
+
+	// CompletionStateFile, if set, is where the completion of uploads
+	// whose parts were all uploaded is saved when it fails.
+	CompletionStateFile string
+
+	// ResumeCompletion makes Upload retry the completion saved in
+	// CompletionStateFile for Uri instead of pushing the image again. If
+	// there is none, or it fails, the image is pushed again.
+	ResumeCompletion bool
+
+	// KeepGoing makes UploadMirror attempt every push even after one of
+	// them failed.
+	KeepGoing bool
+
+	// VerifyStreamedDigest makes the ACI be digested before the push and
+	// while it is uploaded, so that the push fails instead of being
+	// completed if it changed meanwhile. The ACI must be sent as is from
+	// a file, neither streamed nor compressed while uploading it.
+	VerifyStreamedDigest bool
+
+	// IdempotencyKey is sent in an Idempotency-Key header on the
+	// initiation and completion requests, for the server to recognize
+	// retries of the same push. A random one is generated for every push
+	// if empty; resumed completions reuse the key of their push.
+	IdempotencyKey string
+
+	// Parallel is the number of pushes UploadMirror performs at once.
+	// Defaults to 1. With more than one, progress is drawn as lines
+	// prefixed with the URI of their push.
+	Parallel int
+
+	// InitiationBody makes the initiation request carry a JSON body with
+	// the image name, its labels and its size, when known. It is only
+	// understood by servers expecting it; others may reject a non-empty
+	// initiation request.
+	InitiationBody bool
+
+	// SendSize makes the size of the ACI, when known, be sent in an
+	// X-ACI-Size header of the initiation request, for servers to refuse
+	// images over their quota before any transfer. Servers refusing one
+	// reply with a 413 status, returned as a *QuotaError.
+	SendSize bool
+
+	// InlineManifest makes the manifest be sent in the body of the
+	// initiation request, as with InitiationBody, and the manifest part
+	// be skipped when the server tells it took the manifest from there.
+	// Servers not telling so get the manifest part as usual.
+	InlineManifest bool
+
+	// DiscoveryCacheFile, if set along with DiscoveryCacheTTL, is where
+	// the push endpoints discovered for each image name are saved, to be
+	// used instead of performing discovery again for DiscoveryCacheTTL.
+	// They are removed from it when the initiation request can't reach
+	// them.
+	DiscoveryCacheFile string
+	DiscoveryCacheTTL  time.Duration
+
+	// Events, if set, receives the steps of the pushes as they happen,
+	// for callers to display them. It must be consumed concurrently, as
+	// the pushes wait for their events to be received. It is closed
+	// when Upload or UploadMirror returns.
+	Events chan<- UploadEvent
+
+	// FailOnWarning makes the warnings about a push, such as an ACI not
+	// compressed as requested, a signature not looking like one or labels
+	// differing from the manifest's, fail it instead of being printed.
+	// Pushes fail before initiating their upload when possible.
+	FailOnWarning bool
+
+	// Sign, if set, makes the detached signature of the ACI read from r
+	// when Ascpath is empty, instead of it being read from a file.
+	Sign func(r io.Reader) ([]byte, error)
+
+	// PartTransformer, if set, wraps the reader of each part, "manifest",
+	// "signature" or "aci", before it is uploaded, such as to encrypt it
+	// or to compress it otherwise. The transformed parts are sent
+	// chunked, as their size isn't known in advance, and have to be
+	// transformed the same every time for tus uploads to be resumed.
+	PartTransformer func(part string, r io.Reader) (io.Reader, error)
+	// PartHeader, if set, returns headers to send along with each part,
+	// such as one telling of the encryption of PartTransformer. They
+	// override the ones set by acpush.
+	PartHeader func(part string) http.Header
+
+	// Annotations are sent along with the initiation request, as
+	// X-ACPush-Annotation-<name> headers. Servers not supporting them
+	// ignore them.
+	Annotations map[string]string
+	// CompletionExtra holds fields added to the JSON object sent with the
+	// completion of a successful push, such as build metadata, for the
+	// servers understanding them. The fields of the push protocol can't
+	// be among them.
+	CompletionExtra map[string]interface{}
+
+	// Headers are added to every request.
+	Headers http.Header
+
+	// Defaults maps image name prefixes to the push defaults for them.
+	// The longest prefix matching the image name is used.
+	Defaults map[string]PushDefaults
+
+	// Confirm, if set, is called before the upload is initiated and
+	// aborts it with ErrNotConfirmed if it returns false.
+	Confirm func(PushInfo) bool
+
+	// ManifestPolicy, if set, is called with the manifest of the image
+	// before anything is sent, and aborts the push if it returns an
+	// error, for pushes to be denied according to the manifest.
+	ManifestPolicy func(*schema.ImageManifest) error
+
+	// Credentials, if set, provides the authentication headers of every
+	// request, before SetHTTPHeaders is called.
+	Credentials CredentialProvider
+
+	// TLSMinVersion and TLSMaxVersion, if set, bound the TLS versions
+	// negotiated with the servers, as tls.VersionTLS12 for instance. Meta
+	// discovery isn't affected, as it is performed by the discovery
+	// package's own client.
+	TLSMinVersion uint16
+	TLSMaxVersion uint16
+	// CertPins, if set, are the hex SHA-256 digests of the leaf
+	// certificates, or of their public keys, the servers may present.
+	// Connections to servers presenting any other certificate are
+	// refused, even though it is trusted, for discovery and uploads
+	// alike. Several pins allow rotating the certificates. They apply to
+	// every host, the storage ones of presigned URLs included.
+	CertPins []string
+
+	// Resolver, if set, is the host:port of the DNS server to resolve
+	// host names with, for discovery and uploads alike, instead of the
+	// system resolver.
+	Resolver string
+
+	// Proxy, if set, is the URL of the proxy to send the requests
+	// through, for discovery and uploads alike, instead of the one given
+	// by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy string
+	// ProxyAuth, if set, holds the user:password credentials to
+	// authenticate with to the proxy. They are only ever sent to the
+	// proxy, in the Proxy-Authorization header.
+	ProxyAuth string
+	// SOCKS5, if set, is the [user:password@]host:port of the SOCKS5
+	// proxy to send the requests through, for discovery and uploads
+	// alike. It cannot be combined with Proxy, while ProxyAuth still
+	// applies to it.
+	SOCKS5 string
+
+	// AllowInsecureRedirect allows following redirects from https to
+	// http, which are refused by default as they may send credentials
+	// in plaintext.
+	AllowInsecureRedirect bool
+
+	// AlwaysAuth makes the credentials be sent to every host. By default,
+	// they are only sent to the host of the initiation endpoint, as the
+	// part URLs on other hosts are expected to be presigned.
+	AlwaysAuth bool
+
+	// Log, if set, receives a timestamped line for every uploaded part and
+	// for the result of the push, for audit trails.
+	Log io.Writer
+
+	// RedactHeaders are the names of the headers whose values are
+	// replaced in the printed requests, along with the authentication
+	// ones.
+	RedactHeaders []string
+
+	// SetHTTPHeaders is called on every request before being sent.
+	// This is exposed so that the user of acpush can set any headers
+	// necessary for authentication.
+	SetHTTPHeaders func(*http.Request)
+	// Interceptors are run in order on every request before it is sent,
+	// retries and redirects included, after the authentication headers
+	// and SetHTTPHeaders, to compose logging, signing and the like. The
+	// first one returning an error aborts the request, the error being
+	// the one of the push. Unlike SetHTTPHeaders, they also run on the
+	// requests to other hosts than the initiation endpoint's, such as
+	// the presigned ones. The meta discovery requests and the ones of the
+	// TokenAcquirer aren't intercepted.
+	Interceptors []func(*http.Request) error
+
+	// TokenAcquirer, if set, acquires the bearer tokens asked for by the
+	// Bearer challenges of the 401 responses, such as a
+	// DockerTokenAcquirer. The requests rejected are sent again with the
+	// token, which is then sent to the host for the rest of the push in
+	// place of the Credentials.
+	TokenAcquirer TokenAcquirer
+
+	// printOnly is set once the upload has been initiated if
+	// PrintRequests is set.
+	printOnly bool
+
+	// schemas are the schemas read from PayloadSchema, set by upload.
+	schemas payloadSchemas
+
+	// idempotencyKey is the key of the push, set by upload.
+	idempotencyKey string
+	// isStaged is set once the image was copied to a temporary file.
+	isStaged bool
+
+	// progressLines makes progress be drawn as lines prefixed with Uri,
+	// for pushes performed in parallel.
+	progressLines bool
+	// keepEvents is set by UploadMirror, which closes Events itself once
+	// all of its pushes are over.
+	keepEvents bool
+	// progress, if set, counts the bytes of the part being uploaded for
+	// its PartProgress events.
+	progress *partProgress
+
+	// initHost is the host of the initiation endpoint, set once it is
+	// known.
+	initHost string
+	// tus is set when the server takes the parts with the tus protocol.
+	tus bool
+	// session, if set, is the upload session saved to SessionFile.
+	session *savedSession
+	// completion, if set, receives what the response to the successful
+	// completion of the push tells of it.
+	completion *completionReply
+	// digestTrailer is set when uploading a part sent with a Digest
+	// trailer.
+	digestTrailer bool
+	// unix is set when the initiation endpoint is a Unix socket.
+	unix bool
+	// gzipEncoding is set when uploading a part sent with a gzip
+	// Content-Encoding.
+	gzipEncoding bool
+	// closed, if set, receives whether the server closed the connection
+	// after successfully taking the part being uploaded.
+	closed *bool
+	// limiters are the token buckets of the rate limited hosts.
+	limiters *rateLimiters
+	// conns are the semaphores of the hosts with MaxConnsPerHost.
+	conns *connLimiters
+	// tokens are the tokens acquired with TokenAcquirer.
+	tokens *tokenCache
+	// warnings collects the warnings of the push, set by upload.
+	warnings *warnings
+
+	// summary and meter collect what is written to Log, respectively for
+	// the whole push and for the part being uploaded.
+	summary *pushSummary
+	meter   *byteMeter
+
+	// ctx is the context of the requests, set by Upload and uploadPart to
+	// enforce the timeouts.
+	ctx context.Context
+}
+
+// Upload performs the upload of the ACI and signature specified in the
+// Uploader struct.
+func (u Uploader) Upload() error {
+	if u.Events != nil && !u.keepEvents {
+		defer close(u.Events)
+	}
+	u, remove, err := u.staged()
+	if err != nil {
+		return err
+	}
+	defer remove()
+	// The arguments are checked before the image is read for its name.
+	if err := u.checkSwapped(); err != nil {
+		return err
+	}
+	u, err = u.withURI()
+	if err != nil {
+		return err
+	}
+	u = u.withRateLimiters().withConnLimiters().withTokenCache()
+	if u.Log == nil {
+		return u.upload()
+	}
+	u.summary = &pushSummary{}
+	start := time.Now()
+	err = u.upload()
+	u.logResult(err, time.Since(start))
+	return err
+}
+
+// ResolveApp opens the image and derives the name and labels it would be
+// pushed under, without contacting any server. Streamed images are read
+// from up to their manifest, so they can't be pushed afterwards.
+func (u Uploader) ResolveApp() (*discovery.App, error) {
+	u, err := u.withURI()
+	if err != nil {
+		return nil, err
+	}
+	r, err := u.resolve()
+	if err != nil {
+		return nil, err
+	}
+	r.close()
+	return r.app, nil
+}
+
+// ManifestURI returns the URI made of the name and labels of the image
+// manifest, which is pushed to when Uri is empty.
+func (u Uploader) ManifestURI() (string, error) {
+	if u.Streaming && u.Acipath == "-" {
+		return "", fmt.Errorf("the image name can't be taken from the manifest of an image read from stdin")
+	}
+	if u.Format == FormatOCI {
+		return "", fmt.Errorf("OCI images have no name, the URI can't be taken from the manifest")
+	}
+	manifest, image, err := u.openImage(&discovery.App{Labels: make(map[types.ACIdentifier]string)})
+	if err != nil {
+		return "", err
+	}
+	image.Close()
+
+	var labels []string
+	for _, l := range manifest.Labels {
+		labels = append(labels, fmt.Sprintf("%s=%s", l.Name, l.Value))
+	}
+	sort.Strings(labels)
+	uri := strings.Join(append([]string{manifest.Name.String()}, labels...), ",")
+	if _, err := discovery.NewAppFromString(uri); err != nil {
+		return "", fmt.Errorf("invalid URI %q taken from the manifest: %v", uri, err)
+	}
+	if u.Debug {
+		stderr("using the URI from the manifest: %s", uri)
+	}
+	return uri, nil
+}
+
+// withURI returns the uploader with Uri taken from the manifest if empty.
+func (u Uploader) withURI() (Uploader, error) {
+	if u.Uri != "" {
+		return u, nil
+	}
+	uri, err := u.ManifestURI()
+	if err != nil {
+		return u, err
+	}
+	u.Uri = uri
+	return u, nil
+}
+
+// rewrittenURI returns Uri as transformed by URIRewriter, if set.
+func (u Uploader) rewrittenURI() string {
+	if u.URIRewriter == nil {
+		return u.Uri
+	}
+	uri := u.URIRewriter(u.Uri)
+	if u.Debug && uri != u.Uri {
+		stderr("rewrote %s to %s", u.Uri, uri)
+	}
+	return uri
+}
+
+// resolvedImage is the image to push along with the app it is pushed as.
+type resolvedImage struct {
+	app        *discovery.App
+	manifest   *schema.ImageManifest
+	image      io.ReadCloser
+	compressed bool
+	defaults   PushDefaults
+	closers    []io.Closer
+}
+
+func (r *resolvedImage) close() {
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		r.closers[i].Close()
+	}
+}
+
+// resolve parses the image name, opens the image and derives the labels of
+// the app from the defaults and the image manifest. The caller must close
+// the returned image.
+func (u Uploader) resolve() (*resolvedImage, error) {
+	app, err := discovery.NewAppFromString(u.rewrittenURI())
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Repository != "" {
+		if err := overrideRepository(app, u.Repository); err != nil {
+			return nil, err
+		}
+	}
+
+	defaults, hasDefaults := u.findDefaults(app)
+	if hasDefaults {
+		for name, value := range defaults.Labels {
+			if _, ok := app.Labels[types.ACIdentifier(name)]; !ok {
+				app.Labels[types.ACIdentifier(name)] = value
+			}
+		}
+	}
+
+	manifest, image, err := u.openImage(app)
+	if err != nil {
+		return nil, err
+	}
+	if u.DumpManifest {
+		if err := dumpManifest(manifest); err != nil {
+			image.Close()
+			return nil, err
+		}
+	}
+	r := &resolvedImage{
+		app:      app,
+		manifest: manifest,
+		defaults: defaults,
+		closers:  []io.Closer{image},
+	}
+
+	compressedImage, compressed, err := u.compressImage(image)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	if compressedImage != image {
+		r.closers = append(r.closers, compressedImage)
+	}
+	r.image, r.compressed = compressedImage, compressed
+
+	if err := u.deriveLabels(app, manifest, compressed); err != nil {
+		r.close()
+		return nil, err
+	}
+	u.checkExt(app, image, compressed)
+	return r, nil
+}
+
+func (u Uploader) upload() error {
+	if err := checkJitter(u.Jitter); err != nil {
+		return err
+	}
+	if u.ProxyAuth != "" {
+		if _, _, err := splitProxyAuth(u.ProxyAuth); err != nil {
+			return err
+		}
+	}
+	if u.Resume && u.SessionFile == "" {
+		return fmt.Errorf("resuming a push needs the SessionFile it was saved to")
+	}
+	if u.SOCKS5 != "" {
+		if u.Proxy != "" {
+			return fmt.Errorf("a SOCKS5 proxy and an HTTP proxy cannot both be used")
+		}
+		if _, err := socks5URL(u.SOCKS5); err != nil {
+			return err
+		}
+	}
+	if u.ReadBufferSize < 0 {
+		return fmt.Errorf("invalid read buffer size: %d", u.ReadBufferSize)
+	}
+	if err := u.checkCertPins(); err != nil {
+		return err
+	}
+	if err := u.checkPartTransformer(); err != nil {
+		return err
+	}
+	if err := checkCompletionExtra(u.CompletionExtra); err != nil {
+		return err
+	}
+	if u.PayloadSchema != "" {
+		schemas, err := loadPayloadSchemas(u.PayloadSchema)
+		if err != nil {
+			return err
+		}
+		u.schemas = schemas
+		// The successful completion is known in advance, and checked
+		// before the parts are uploaded rather than after.
+		blob, err := withExtraFields(completeMsg{Success: true}, u.CompletionExtra)
+		if err != nil {
+			return err
+		}
+		if err := u.validatePayload("completion", blob); err != nil {
+			return err
+		}
+	}
+	switch u.ContentEncoding {
+	case "":
+	case CompressionGzip:
+		if u.Compress != "" {
+			return fmt.Errorf("can't compress the image and send it with a Content-Encoding at once")
+		}
+		if _, err := u.compressLevel(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown content encoding: %q", u.ContentEncoding)
+	}
+	ifMatch := u.ETags[u.Uri]
+	if ifMatch != "" && u.NoOverwrite {
+		return fmt.Errorf("can't push with NoOverwrite and the ETag of the last push at once")
+	}
+
+	u.warnings = &warnings{}
+	defer u.printWarnings()
+	ascfile, err := u.signature()
+	if err != nil {
+		return err
+	}
+	defer ascfile.Close()
+	if err := u.checkSignature(ascfile); err != nil {
+		return err
+	}
+
+	u.idempotencyKey = u.IdempotencyKey
+	if u.idempotencyKey == "" {
+		if u.idempotencyKey, err = newIdempotencyKey(); err != nil {
+			return err
+		}
+	}
+
+	r, err := u.resolve()
+	if err != nil {
+		return err
+	}
+	defer r.close()
+	app, manifest, image, compressed, defaults := r.app, r.manifest, r.image, r.compressed, r.defaults
+	u.checkLabels(app, manifest)
+
+	maxACVersion := u.MaxACVersion
+	if maxACVersion == "" {
+		maxACVersion = maxSupportedACVersion()
+	}
+	if err := checkACVersion(manifest.ACVersion, u.MinACVersion, maxACVersion); err != nil {
+		return err
+	}
+	if u.ManifestPolicy != nil {
+		if err := u.ManifestPolicy(manifest); err != nil {
+			return fmt.Errorf("image denied by the manifest policy: %v", err)
+		}
+	}
+
+	var aciDigest string
+	if u.VerifyStreamedDigest {
+		if aciDigest, err = fileDigest(image); err != nil {
+			return err
+		}
+	}
+
+	manblob, err := manifest.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	if u.ResumeCompletion && u.CompletionStateFile != "" && !u.PrintRequests {
+		completed, err := u.resumeCompletion()
+		if err != nil {
+			return err
+		}
+		if completed {
+			if u.VerifyAfterPush {
+				return u.verifyPush(app)
+			}
+			return nil
+		}
+	}
+
+	digestParts, err := u.digestParts()
+	if err != nil {
+		return err
+	}
+
+	initHeader, err := u.annotationHeader()
+	if err != nil {
+		return err
+	}
+
+	var digest string
+	if u.ContentAddressable {
+		if digest, err = u.imageID(); err != nil {
+			return err
+		}
+	}
+
+	endpoint := defaults.Endpoint
+	if u.Endpoint != "" {
+		endpoint = u.Endpoint
+	}
+	initurl, err := u.getInitiationURL(app, endpoint, digest)
+	if err != nil {
+		return err
+	}
+	u.unix = strings.HasPrefix(initurl, "unix:")
+	u.sendEvent(UploadEvent{Kind: EndpointResolved, URL: initurl})
+
+	if u.summary != nil {
+		u.summary.endpoint = initurl
+	}
+
+	// Nothing was sent to the server yet, so strict pushes fail before
+	// initiating the upload.
+	if err := u.checkWarnings(); err != nil {
+		return err
+	}
+
+	if u.Confirm != nil && !u.Confirm(u.pushInfo(app, initurl)) {
+		return ErrNotConfirmed
+	}
+
+	if u.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(u.context(), u.Timeout)
+		defer cancel()
+		u.ctx = ctx
+	}
+
+	// The size of an image compressed while being uploaded isn't known
+	// in advance.
+	size := int64(-1)
+	if !compressed {
+		size = u.pushInfo(app, "").Size
+	}
+	if u.SendSize && size >= 0 {
+		initHeader.Set(sizeHeader, strconv.FormatInt(size, 10))
+	}
+
+	if u.Resume && u.savesSession() {
+		if u.session, err = u.resumedSession(); err != nil {
+			return err
+		}
+	}
+	initDeets := &initiateDetails{}
+	if u.session != nil {
+		// The upload was initiated by the push resumed.
+		*initDeets = u.session.Details
+		u.initHost = u.session.InitHost
+		if u.session.IdempotencyKey != "" {
+			u.idempotencyKey = u.session.IdempotencyKey
+		}
+	} else {
+		var initBody []byte
+		if u.InitiationBody || u.InlineManifest {
+			initBody, err = u.initiationBody(app, compressed, manblob)
+			if err != nil {
+				return err
+			}
+			if err := u.validatePayload("initiation", initBody); err != nil {
+				return err
+			}
+		}
+
+		initDeets, err = u.initiateUpload(initurl, initHeader, initBody)
+		if qerr, ok := err.(*QuotaError); ok && qerr.Size == 0 && size > 0 {
+			qerr.Size = size
+		}
+		if err != nil {
+			// The endpoint may have moved since it was discovered.
+			if endpoint == "" && u.discoveryCached() && isConnectionError(err) {
+				u.forgetDiscovery(app)
+			}
+			return err
+		}
+		if parsed, err := url.Parse(initurl); err == nil {
+			u.initHost = parsed.Host
+		}
+		u.sendEvent(UploadEvent{Kind: InitiationComplete, URL: initurl})
+		if u.savesSession() {
+			u.session = u.newSession(initDeets)
+		}
+	}
+	if err := checkACVersion(manifest.ACVersion, initDeets.MinACVersion, initDeets.MaxACVersion); err != nil {
+		reason := fmt.Errorf("server doesn't accept the image: %v", err)
+		if reportErr := u.reportFailure(initDeets.CompletedURL, reason.Error()); reportErr != nil {
+			return fmt.Errorf("%v, and error reporting failure: %v", reason, reportErr)
+		}
+		return reason
+	}
+	switch initDeets.UploadProtocol {
+	case "":
+	case uploadProtocolTus:
+		u.tus = true
+	default:
+		reason := fmt.Errorf("unsupported upload protocol: %q", initDeets.UploadProtocol)
+		if reportErr := u.reportFailure(initDeets.CompletedURL, reason.Error()); reportErr != nil {
+			return fmt.Errorf("%v, and error reporting failure: %v", reason, reportErr)
+		}
+		return reason
+	}
+	u.printOnly = u.PrintRequests
+
+	parts, err := orderParts([]partToUpload{
+		partToUpload{"manifest", initDeets.ManifestURL, bytes.NewReader(manblob), false},
+		partToUpload{"signature", initDeets.SignatureURL, ascfile, true},
+		partToUpload{"ACI", initDeets.ACIURL, image, true},
+	}, initDeets.PartOrder)
+	if err != nil {
+		return err
+	}
+	if u.InlineManifest && initDeets.ManifestInlined {
+		if u.Debug {
+			stderr("manifest sent with the initiation request, skipping its upload")
+		}
+		parts = withoutPart(parts, "manifest")
+	}
+
+	var lastClosed bool
+	for i, part := range parts {
+		if u.sessionDone(part.label) {
+			if u.Debug {
+				stderr("%s uploaded by the session resumed, skipping it", part.label)
+			}
+			continue
+		}
+		var header http.Header
+		pu := u
+		if i == len(parts)-1 {
+			pu.closed = &lastClosed
+		}
+		if digestParts[strings.ToLower(part.label)] {
+			if u.DigestTrailer && !u.tus {
+				pu.digestTrailer = true
+			} else if u.PartTransformer != nil {
+				err = fmt.Errorf("the tus protocol doesn't allow the digests of transformed parts")
+			} else {
+				header, err = u.digestHeader(part)
+			}
+		}
+		if err == nil && part.label == "ACI" && u.ContentEncoding != "" {
+			if u.tus {
+				err = fmt.Errorf("the tus protocol doesn't allow a Content-Encoding")
+			}
+			pu.gzipEncoding = true
+		}
+		if err == nil && part.label == "ACI" && u.NoOverwrite {
+			if header == nil {
+				header = make(http.Header)
+			}
+			header.Set("If-None-Match", "*")
+		}
+		if err == nil && part.label == "ACI" && ifMatch != "" {
+			if header == nil {
+				header = make(http.Header)
+			}
+			header.Set("If-Match", ifMatch)
+		}
+		if err == nil {
+			err = u.checkWarnings()
+		}
+		var sent *byteMeter
+		if err == nil {
+			sent, err = pu.uploadPart(part.url, header, part.r, part.draw, part.label)
+		}
+		if err == errPreconditionFailed && u.NoOverwrite {
+			err = ErrImageExists
+		} else if err == errPreconditionFailed && ifMatch != "" {
+			err = ErrImageChanged
+		}
+		if err != nil {
+			var n int64
+			if sent != nil {
+				n = sent.n
+			}
+			reason := fmt.Errorf("error uploading %s: %v", part.label, err)
+			// The server isn't told of the failure, which would have
+			// it drop the upload, while it can still be resumed.
+			if u.session != nil && u.tus && (transient(err) || isTusRetryable(err)) {
+				return fmt.Errorf("%v (the upload session was saved, it can be resumed)", reason)
+			}
+			reportErr := u.reportPartFailure(initDeets.CompletedURL, reason.Error(), part.label, n)
+			if reportErr != nil {
+				return fmt.Errorf("error uploading %s and error reporting failure: %v, %v", part.label, err, reportErr)
+			}
+			return reason
+		}
+		if part.label == "ACI" && aciDigest != "" && !u.printOnly && sent.digest() != aciDigest {
+			reason := fmt.Errorf("ACI changed while uploading it: its digest was %s, %s was sent", aciDigest, sent.digest())
+			if reportErr := u.reportFailure(initDeets.CompletedURL, reason.Error()); reportErr != nil {
+				return fmt.Errorf("%v, and error reporting failure: %v", reason, reportErr)
+			}
+			return reason
+		}
+		u.recordDone(part.label)
+	}
+	// Once the parts are all uploaded, only the completion is left to
+	// resume.
+	if u.session != nil {
+		u.dropSession()
+	}
+
+	// Some servers complete the push on their own, in which case there
+	// is no completion to report.
+	switch {
+	case initDeets.CompletedURL == "":
+		if u.Debug {
+			stderr("no completion URL given, the push is complete")
+		}
+		err = nil
+	case initDeets.NoCompletion && lastClosed:
+		if u.Debug {
+			stderr("connection closed by the server after the last part, skipping the completion")
+		}
+		err = nil
+	default:
+		err = u.reportSuccess(initDeets.CompletedURL)
+		if err == nil {
+			u.sendEvent(UploadEvent{Kind: CompletionComplete, URL: initDeets.CompletedURL})
+		}
+	}
+	if err != nil {
+		if u.CompletionStateFile == "" || u.printOnly {
+			return err
+		}
+		if saveErr := u.saveCompletion(initDeets.CompletedURL); saveErr != nil {
+			return fmt.Errorf("%v, and error saving the completion: %v", err, saveErr)
+		}
+		return fmt.Errorf("%v (all parts were uploaded, the completion can be resumed)", err)
+	}
+
+	if u.VerifyAfterPush && !u.printOnly {
+		// The image is fetched as any other, with credentials for
+		// whatever host it is found on.
+		u.initHost = ""
+		return u.verifyPush(app)
+	}
+
+	return nil
+}
+
+var errPreconditionFailed = errors.New("precondition failed")
+
+// ErrImageExists is the error reported when the server rejects an upload
+// made with NoOverwrite because the image version already exists.
+var ErrImageExists = errors.New("image version already exists")
+
+// ErrImageChanged is the error reported when the server rejects an upload
+// made with the ETag of the last push because the image was pushed since.
+var ErrImageChanged = errors.New("image changed since last push")
+
+// ErrNotAttempted is the error reported by UploadMirror for the pushes
+// skipped after a failed one.
+var ErrNotAttempted = errors.New("not attempted after an earlier failure")
+
+// UploadMirror pushes the ACI and signature specified in the Uploader
+// struct to each of the given URIs, ignoring Uri, up to Parallel of them at
+// once. The returned slice holds the error of each push, nil if it
+// succeeded, in the order of the URIs. Unless KeepGoing is set, the pushes
+// not started yet when one fails are skipped and reported with
+// ErrNotAttempted.
+func (u Uploader) UploadMirror(uris []string) []error {
+	if u.Events != nil {
+		defer close(u.Events)
+		u.keepEvents = true
+	}
+	// The image is staged once for all the pushes.
+	u, remove, err := u.staged()
+	if err != nil {
+		errs := make([]error, len(uris))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	defer remove()
+	u = u.withRateLimiters().withConnLimiters().withTokenCache()
+	errs := make([]error, len(uris))
+	workers := u.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(uris) {
+		workers = len(uris)
+	}
+
+	var (
+		mu     sync.Mutex
+		next   int
+		failed bool
+		wg     sync.WaitGroup
+	)
+	push := func() {
+		defer wg.Done()
+		for {
+			mu.Lock()
+			if next == len(uris) {
+				mu.Unlock()
+				return
+			}
+			i := next
+			next++
+			skip := failed && !u.KeepGoing
+			mu.Unlock()
 
-type completeMsg struct {
-	Success      bool   `json:"success"`
-	Reason       string `json:"reason,omitempty"`
-	ServerReason string `json:"server_reason,omitempty"`
+			if skip {
+				errs[i] = ErrNotAttempted
+				continue
+			}
+			mirror := u
+			mirror.Uri = uris[i]
+			mirror.progressLines = workers > 1
+			if errs[i] = mirror.Upload(); errs[i] != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}
+	}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go push()
+	}
+	wg.Wait()
+	return errs
 }
 
-func stderr(format string, a ...interface{}) {
-	out := fmt.Sprintf(format, a...)
-	fmt.Fprintln(os.Stderr, strings.TrimSuffix(out, "\n"))
+type partToUpload struct {
+	label string
+	url   string
+	r     io.Reader
+	draw  bool
 }
 
-// Uploader holds information about an upload to be performed.
-type Uploader struct {
-	Acipath  string
-	Ascpath  string
-	Uri      string
-	Insecure bool
-	Debug    bool
+// orderParts returns the parts in the given order, which lists each part by
+// its case-insensitive label. If order is empty, the parts are returned as
+// they are.
+func orderParts(parts []partToUpload, order []string) ([]partToUpload, error) {
+	if len(order) == 0 {
+		return parts, nil
+	}
+	if len(order) != len(parts) {
+		return nil, fmt.Errorf("server requested an invalid part order: %v", order)
+	}
+	ordered := make([]partToUpload, 0, len(parts))
+	seen := make(map[string]bool)
+	for _, name := range order {
+		name = strings.ToLower(name)
+		found := false
+		for _, part := range parts {
+			if strings.ToLower(part.label) == name && !seen[name] {
+				ordered = append(ordered, part)
+				seen[name] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("server requested an invalid part order: %v", order)
+		}
+	}
+	return ordered, nil
+}
 
-	// SetHTTPHeaders is called on every request before being sent.
-	// This is exposed so that the user of acpush can set any headers
-	// necessary for authentication.
-	SetHTTPHeaders func(*http.Request)
+// withoutPart returns the parts but the one with the given label.
+func withoutPart(parts []partToUpload, label string) []partToUpload {
+	var kept []partToUpload
+	for _, part := range parts {
+		if part.label != label {
+			kept = append(kept, part)
+		}
+	}
+	return kept
 }
 
-// Upload performs the upload of the ACI and signature specified in the
-// Uploader struct.
-func (u Uploader) Upload() error {
-	acifile, err := os.Open(u.Acipath)
+// overrideRepository replaces the app's name with the one of repository,
+// keeping the app's labels. Labels given in repository are added to the
+// app's, and must not conflict with them.
+func overrideRepository(app *discovery.App, repository string) error {
+	repo, err := discovery.NewAppFromString(repository)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid repository %q: %v", repository, err)
+	}
+	for name, value := range repo.Labels {
+		if v, ok := app.Labels[name]; ok && v != value {
+			return fmt.Errorf("repository %q sets label %q to %q, conflicting with %q", repository, name, value, v)
+		}
+		app.Labels[name] = value
 	}
-	defer acifile.Close()
+	app.Name = repo.Name
+	return nil
+}
 
-	ascfile, err := os.Open(u.Ascpath)
-	if err != nil {
-		return err
+// openImage opens the image to upload and reads its manifest. The returned
+// reader yields the contents to upload for the ACI part.
+func (u Uploader) openImage(app *discovery.App) (*schema.ImageManifest, io.ReadCloser, error) {
+	switch u.Format {
+	case "", FormatACI:
+		if u.Streaming {
+			return openStreamedACI(u.Acipath)
+		}
+		acifile, err := os.Open(u.Acipath)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest, err := manifestFromImage(u.Acipath, acifile)
+		if err == nil {
+			// Just to make sure that we start reading from the front
+			// of the file in case manifestFromImage changed the
+			// cursor into the file.
+			_, err = acifile.Seek(0, 0)
+		}
+		if err != nil {
+			acifile.Close()
+			return nil, nil, err
+		}
+		return manifest, acifile, nil
+	case FormatOCI:
+		if u.Streaming {
+			return nil, nil, fmt.Errorf("streaming is only supported for ACI images")
+		}
+		return openOCIImage(u.Acipath, app)
+	case FormatACIDir:
+		if u.Streaming {
+			return nil, nil, fmt.Errorf("streaming is only supported for ACI images")
+		}
+		return openACIDir(u.Acipath)
+	default:
+		return nil, nil, fmt.Errorf("unknown image format: %q", u.Format)
 	}
-	defer ascfile.Close()
+}
 
-	manifest, err := aci.ManifestFromImage(acifile)
-	if err != nil {
-		return err
+// deriveLabels sets the labels needed for discovery which are missing from
+// the app, taking them from the manifest.
+func (u Uploader) deriveLabels(app *discovery.App, manifest *schema.ImageManifest, compressed bool) error {
+	var names []string
+	if !u.NoAutoLabel {
+		names = append(names, archLabelName, osLabelName)
 	}
-	app, err := discovery.NewAppFromString(u.Uri)
-	if err != nil {
-		return err
+	for name, annotation := range u.LabelAnnotations {
+		if _, err := types.NewACIdentifier(name); err != nil {
+			return fmt.Errorf("invalid label %q to read from an annotation: %v", name, err)
+		}
+		if _, err := types.NewACIdentifier(annotation); err != nil {
+			return fmt.Errorf("invalid annotation %q to read label %q from: %v", annotation, name, err)
+		}
 	}
-
-	if _, ok := app.Labels[archLabelName]; !ok {
-		arch, ok := manifest.Labels.Get(archLabelName)
-		if !ok {
-			return fmt.Errorf("manifest is missing label: %q", archLabelName)
+	for _, name := range u.RequiredLabels {
+		if _, err := types.NewACIdentifier(name); err != nil {
+			return fmt.Errorf("invalid required label %q: %v", name, err)
+		}
+		// The ext label is derived from the image format rather than
+		// the manifest.
+		if name != extLabelName {
+			names = append(names, name)
 		}
-		app.Labels[archLabelName] = arch
 	}
 
-	if _, ok := app.Labels[osLabelName]; !ok {
-		os, ok := manifest.Labels.Get(osLabelName)
+	// Labels missing from the URI are taken from the manifest, then from
+	// the annotations they are mapped to, falling back to the defaults.
+	fallbacks := map[string]string{
+		archLabelName: u.DefaultArch,
+		osLabelName:   u.DefaultOS,
+	}
+	var missing []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if _, ok := app.Labels[types.ACIdentifier(name)]; ok {
+			continue
+		}
+		value, ok := manifest.Labels.Get(name)
+		if annotation, mapped := u.LabelAnnotations[name]; !ok && mapped {
+			value, ok = manifest.Annotations.Get(annotation)
+			if ok && u.Debug {
+				stderr("label %q taken from annotation %q: %s", name, annotation, value)
+			}
+		}
 		if !ok {
-			return fmt.Errorf("manifest is missing label: %q", osLabelName)
+			value = fallbacks[name]
 		}
-		app.Labels[osLabelName] = os
+		if value == "" {
+			missing = append(missing, fmt.Sprintf("%q", name))
+			continue
+		}
+		app.Labels[types.ACIdentifier(name)] = value
+	}
+	switch len(missing) {
+	case 0:
+	case 1:
+		return fmt.Errorf("manifest is missing label: %s", missing[0])
+	default:
+		return fmt.Errorf("manifest is missing labels: %s", strings.Join(missing, ", "))
 	}
 
+	// An explicit Ext applies even without the derived labels.
+	if u.NoAutoLabel && u.Ext == "" {
+		return nil
+	}
 	if _, ok := app.Labels[extLabelName]; !ok {
-		app.Labels[extLabelName] = strings.Trim(schema.ACIExtension, ".")
+		ext, err := u.extLabel(compressed)
+		if err != nil {
+			return err
+		}
+		app.Labels[extLabelName] = ext
 	}
+	return nil
+}
 
-	// Just to make sure that we start reading from the front of the file in
-	// case aci.ManifestFromImage changed the cursor into the file.
-	_, err = acifile.Seek(0, 0)
-	if err != nil {
-		return err
+// findDefaults returns the push defaults registered for the longest prefix
+// of the app's name.
+func (u Uploader) findDefaults(app *discovery.App) (PushDefaults, bool) {
+	var (
+		found   bool
+		longest string
+	)
+	name := app.Name.String()
+	for prefix := range u.Defaults {
+		if strings.HasPrefix(name, prefix) && len(prefix) >= len(longest) {
+			longest = prefix
+			found = true
+		}
 	}
-
-	manblob, err := manifest.MarshalJSON()
-	if err != nil {
-		return err
+	if !found {
+		return PushDefaults{}, false
 	}
+	return u.Defaults[longest], true
+}
 
-	initurl, err := u.getInitiationURL(app)
-	if err != nil {
-		return err
+func (u Uploader) getInitiationURL(app *discovery.App, endpoint, digest string) (string, error) {
+	if endpoint != "" {
+		url, err := renderEndpoint(expandDigest(endpoint, digest), app)
+		if err != nil {
+			return "", err
+		}
+		if u.Debug {
+			stderr("push endpoint found in config: %s", url)
+		}
+		return url, nil
 	}
 
-	initDeets, err := u.initiateUpload(initurl)
+	u.sendEvent(UploadEvent{Kind: DiscoveryStarted})
+	var eps []string
+	var err error
+	if u.discoveryCached() {
+		eps, _, err = u.cachedPushEndpoints(app)
+	} else {
+		eps, _, err = u.discoverPushEndpoints(app)
+	}
+	if derr, ok := err.(*DiscoveryError); ok {
+		derr.Hints = u.discoveryHints(derr)
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	type partToUpload struct {
-		label string
-		url   string
-		r     io.Reader
-		draw  bool
+	if u.Debug {
+		stderr("push endpoint found: %s", eps[0])
 	}
 
-	for _, part := range []partToUpload{
-		partToUpload{"manifest", initDeets.ManifestURL, bytes.NewReader(manblob), false},
-		partToUpload{"signature", initDeets.SignatureURL, ascfile, true},
-		partToUpload{"ACI", initDeets.ACIURL, acifile, true},
-	} {
-		err = u.uploadPart(part.url, part.r, part.draw, part.label)
-		if err != nil {
-			reason := fmt.Errorf("error uploading %s: %v", part.label, err)
-			reportErr := u.reportFailure(initDeets.CompletedURL, reason.Error())
-			if reportErr != nil {
-				return fmt.Errorf("error uploading %s and error reporting failure: %v, %v", part.label, err, reportErr)
-			}
-			return reason
+	if digest != "" {
+		if !strings.Contains(eps[0], digestPlaceholder) {
+			return "", fmt.Errorf("push endpoint %s has no %s placeholder for a content-addressable push", eps[0], digestPlaceholder)
 		}
+		return expandDigest(eps[0], digest), nil
 	}
+	return eps[0], nil
+}
 
-	err = u.reportSuccess(initDeets.CompletedURL)
-	if err != nil {
-		return err
+// renderEndpoint substitutes the app's name and labels into the given push
+// endpoint template.
+func renderEndpoint(tpl string, app *discovery.App) (string, error) {
+	app = app.Copy()
+	if app.Labels["version"] == "" {
+		app.Labels["version"] = "latest"
+	}
+	url := strings.Replace(tpl, "{name}", app.Name.String(), -1)
+	for name, value := range app.Labels {
+		url = strings.Replace(url, fmt.Sprintf("{%s}", name), value, -1)
 	}
+	if strings.Contains(url, "{") {
+		return "", fmt.Errorf("unresolved variables in push endpoint: %s", url)
+	}
+	return url, nil
+}
 
-	return nil
+// annotationHeader returns the headers carrying the push-time annotations.
+func (u Uploader) annotationHeader() (http.Header, error) {
+	header := make(http.Header)
+	for name, value := range u.Annotations {
+		if !validHeaderToken(name) {
+			return nil, fmt.Errorf("invalid annotation name: %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid value for annotation %q", name)
+		}
+		header.Set(annotationHeaderPrefix+name, value)
+	}
+	return header, nil
 }
 
-func (u Uploader) getInitiationURL(app *discovery.App) (string, error) {
-	if u.Debug {
-		stderr("searching for push endpoint via meta discovery")
+// validHeaderToken returns whether s can be used as (part of) a header name.
+func validHeaderToken(s string) bool {
+	if s == "" {
+		return false
 	}
-	eps, attempts, err := discovery.DiscoverEndpoints(*app, u.Insecure)
-	if u.Debug {
-		for _, a := range attempts {
-			stderr("meta tag 'ac-push-discovery' not found on %s: %v", a.Prefix, a.Error)
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
 		}
 	}
-	if err != nil {
-		return "", err
+	return true
+}
+
+// initiationBody returns the JSON body describing the image sent with the
+// initiation request.
+func (u Uploader) initiationBody(app *discovery.App, compressed bool, manblob []byte) ([]byte, error) {
+	info := u.pushInfo(app, "")
+	body := initiateBody{
+		Name:   info.Name,
+		Labels: info.Labels,
 	}
-	if len(eps.ACIPushEndpoints) == 0 {
-		return "", fmt.Errorf("no endpoints discovered")
+	if u.InlineManifest {
+		body.Manifest = manblob
 	}
-
-	if u.Debug {
-		stderr("push endpoint found: %s", eps.ACIPushEndpoints[0])
+	// The size of an image compressed while being uploaded isn't known
+	// in advance.
+	if !compressed && info.Size >= 0 {
+		body.Size = info.Size
 	}
-
-	return eps.ACIPushEndpoints[0], nil
+	return json.Marshal(body)
 }
 
-func (u Uploader) initiateUpload(initurl string) (*initiateDetails, error) {
+func (u Uploader) initiateUpload(initurl string, header http.Header, body []byte) (*initiateDetails, error) {
 	if u.Debug {
 		stderr("initiating upload")
 	}
-	resp, err := u.performRequest("POST", initurl, nil, false, "")
+	header = u.withIdempotencyKey(withAcceptEncoding(header))
+	var bodyReader io.Reader
+	if body != nil {
+		if u.Debug {
+			stderr(" - initiation body: %s", body)
+		}
+		header.Set("Content-Type", "application/json")
+		bodyReader = bytes.NewReader(body)
+	}
+	resp, err := u.performRequest("POST", initurl, header, bodyReader, false, "")
 	if err != nil {
 		return nil, err
 	}
@@ -210,6 +1614,9 @@ func (u Uploader) initiateUpload(initurl string) (*initiateDetails, error) {
 
 	deets := &initiateDetails{}
 	err = json.Unmarshal(respblob, deets)
+	if err == nil {
+		err = deets.resolveURLs(initurl)
+	}
 
 	if u.Debug {
 		stderr("upload initiated")
@@ -221,25 +1628,102 @@ func (u Uploader) initiateUpload(initurl string) (*initiateDetails, error) {
 	return deets, err
 }
 
-func (u Uploader) uploadPart(url string, body io.Reader, draw bool, label string) error {
-	resp, err := u.performRequest("PUT", url, body, draw, label)
+// uploadPart uploads a part of the image, returning the meter of the bytes
+// of it sent, even when the upload fails.
+func (u Uploader) uploadPart(url string, header http.Header, body io.Reader, draw bool, label string) (*byteMeter, error) {
+	parent := u.context()
+	if u.PartTimeout > 0 {
+		ctx, cancel := context.WithTimeout(parent, u.PartTimeout)
+		defer cancel()
+		u.ctx = ctx
+	}
+	// The digest is only needed for the log and to verify the ACI sent.
+	u.meter = newByteMeter(u.Log != nil || (u.VerifyStreamedDigest && label == "ACI"))
+	header, body, err := u.transformPart(label, header, body)
+	if err != nil {
+		return u.meter, err
+	}
+	if u.Events != nil {
+		size := bodySize(body)
+		u.progress = &partProgress{u: u, event: UploadEvent{Kind: PartProgress, URL: url, Part: label, Size: size}}
+		u.sendEvent(UploadEvent{Kind: PartStarted, URL: url, Part: label, Size: size})
+	}
+	start := time.Now()
+	if u.tus {
+		err = u.tusUpload(url, header, body, draw, label)
+	} else {
+		var resp io.ReadCloser
+		if resp, err = u.performRequest("PUT", url, header, body, draw, label); err == nil {
+			resp.Close()
+		}
+	}
+	if err != nil {
+		if u.PartTimeout > 0 && u.ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			return u.meter, fmt.Errorf("timed out after %v", u.PartTimeout)
+		}
+		return u.meter, err
+	}
+
+	if u.progress != nil {
+		event := u.progress.event
+		event.Kind = PartComplete
+		u.sendEvent(event)
+	}
+	if u.Log != nil && !u.printOnly {
+		u.logf("%s uploaded to %s in %v, %d bytes, %s", label, url, time.Since(start), u.meter.n, u.meter.digest())
+		if label == "ACI" && u.summary != nil {
+			u.summary.aciBytes = u.meter.n
+			u.summary.aciDigest = u.meter.digest()
+		}
+	}
+	return u.meter, nil
+}
+
+func (u Uploader) reportSuccess(url string) error {
+	respblob, err := withExtraFields(completeMsg{Success: true}, u.CompletionExtra)
 	if err != nil {
 		return err
 	}
-	resp.Close()
+	reply := &completionReply{}
+	u.completion = reply
+	if err := u.complete(url, respblob); err != nil {
+		return err
+	}
+	if u.printOnly {
+		return nil
+	}
+	if reply.etag != "" && u.RecordETag != nil {
+		u.RecordETag(u.Uri, reply.etag)
+	}
+	if reply.message != "" && u.CompletionMessage != nil {
+		u.CompletionMessage(u.Uri, reply.message)
+	}
 	return nil
 }
 
-func (u Uploader) reportSuccess(url string) error {
-	respblob, err := json.Marshal(completeMsg{true, "", ""})
+func (u Uploader) reportFailure(url string, reason string) error {
+	if u.session != nil {
+		u.dropSession()
+	}
+	respblob, err := json.Marshal(completeMsg{Success: false, Reason: reason})
 	if err != nil {
 		return err
 	}
 	return u.complete(url, respblob)
 }
 
-func (u Uploader) reportFailure(url string, reason string) error {
-	respblob, err := json.Marshal(completeMsg{false, reason, ""})
+// reportPartFailure reports the failed upload of a part, along with how
+// much of it was sent.
+func (u Uploader) reportPartFailure(url, reason, part string, sent int64) error {
+	if u.session != nil {
+		u.dropSession()
+	}
+	respblob, err := json.Marshal(completeMsg{
+		Success:    false,
+		Reason:     reason,
+		FailedPart: strings.ToLower(part),
+		BytesSent:  &sent,
+	})
 	if err != nil {
 		return err
 	}
@@ -247,17 +1731,47 @@ func (u Uploader) reportFailure(url string, reason string) error {
 }
 
 func (u Uploader) complete(url string, blob []byte) error {
-	resp, err := u.performRequest("POST", url, bytes.NewReader(blob), false, "")
+	// Without a completion URL, the failures have nowhere to be
+	// reported.
+	if url == "" {
+		return nil
+	}
+	if err := u.validatePayload("completion", blob); err != nil {
+		return err
+	}
+	header := u.withIdempotencyKey(withAcceptEncoding(nil))
+	resp, err := u.performRequest("POST", url, header, bytes.NewReader(blob), false, "")
+	// Completing again is cheap, unlike uploading the parts again.
+	for retry := 1; err != nil && retry <= u.CompletionRetries && transient(err) && u.context().Err() == nil; retry++ {
+		delay := u.completionBackoff(retry)
+		if u.Debug {
+			stderr("completion failed, retrying in %v: %v", delay, err)
+		}
+		if serr := u.sleep(delay); serr != nil {
+			return fmt.Errorf("%v, and not retrying: %v", err, serr)
+		}
+		resp, err = u.performRequest("POST", url, header, bytes.NewReader(blob), false, "")
+	}
 	if err != nil {
 		return err
 	}
-	defer resp.Close()
+	// Only the response to the completion is of interest, not the ones
+	// of the job polls.
+	completion := u.completion
+	u.completion = nil
 
+	// The response is closed before polling the job, for its connection
+	// not to count against MaxConnsPerHost meanwhile.
 	respblob, err := ioutil.ReadAll(resp)
+	resp.Close()
 	if err != nil {
 		return err
 	}
 
+	if u.printOnly {
+		return nil
+	}
+
 	reply := &completeMsg{}
 	err = json.Unmarshal(respblob, reply)
 	if err != nil {
@@ -267,60 +1781,264 @@ func (u Uploader) complete(url string, blob []byte) error {
 	if !reply.Success {
 		return fmt.Errorf("%s", reply.ServerReason)
 	}
+	if completion != nil {
+		completion.message = reply.ServerReason
+	}
+
+	if reply.JobURL != "" {
+		return u.pollJob(reply.JobID, reply.JobURL)
+	}
 
 	return nil
 }
 
-func (u Uploader) performRequest(reqType string, url string, body io.Reader, draw bool, label string) (io.ReadCloser, error) {
-	if fbody, ok := body.(*os.File); draw && ok && u.Debug {
+func (u Uploader) performRequest(reqType string, url string, header http.Header, body io.Reader, draw bool, label string) (io.ReadCloser, error) {
+	// The body given is the one printed, before it's wrapped below.
+	src := body
+	fbody, isFile := body.(*os.File)
+	var (
+		offset int64
+		reads  *readCounter
+	)
+	// Printed requests aren't sent, their file isn't read.
+	if isFile && !u.printOnly {
 		var err error
-		body, err = genProgressBar(fbody, label)
+		offset, err = fbody.Seek(0, 1)
 		if err != nil {
 			return nil, err
 		}
+		if u.ReadBufferSize > 0 {
+			reads = &readCounter{}
+		}
+		bar := ""
+		if draw && u.Debug {
+			bar = label
+		}
+		if body, err = u.fileBody(fbody, offset, bar, reads); err != nil {
+			return nil, err
+		}
 	}
 
-	req, err := http.NewRequest(reqType, url, body)
+	ctx := u.context()
+	if u.TraceTiming {
+		ctx = withTimingTrace(ctx, reqType)
+	}
+	req, err := http.NewRequestWithContext(ctx, reqType, url, body)
 	if err != nil {
 		return nil, err
 	}
-	transport := http.DefaultTransport
-	if u.Insecure {
-		transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	if isFile {
+		// Allows the body to be sent again when being redirected.
+		req.GetBody = func() (io.ReadCloser, error) {
+			bar := ""
+			if draw && u.Debug && !u.NoProgressWhenRedirected {
+				// Finish the line of the previous bar, so the
+				// new one doesn't overwrite it.
+				fmt.Fprintln(os.Stderr)
+				bar = label + " (restarted after redirect)"
+			}
+			return u.fileBody(fbody, offset, bar, reads)
 		}
 	}
 
-	u.SetHTTPHeaders(req)
-
-	client := &http.Client{Transport: transport}
+	if u.meter != nil {
+		u.meter.meter(req)
+	}
+	u.limitBody(req)
+	u.reportProgress(req)
+	if u.digestTrailer {
+		sendDigestTrailer(req)
+	}
 
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		if len(via) >= 10 {
-			return fmt.Errorf("too many redirects")
+	if err := u.setHeaders(req, header); err != nil {
+		return nil, err
+	}
+	if u.Curl {
+		if err := u.printCurl(req, src); err != nil {
+			return nil, err
 		}
-		u.SetHTTPHeaders(req)
-		return nil
+	}
+	if u.printOnly {
+		u.printRequest(req, label, bodySize(src))
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if u.gzipEncoding {
+		// The level was validated already.
+		level, _ := u.compressLevel()
+		gzipEncodeBody(req, level)
 	}
 
-	res, err := client.Do(req)
+	res, err := u.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode == http.StatusUnauthorized && u.retriesUnauthorized(res) {
+		res.Body.Close()
+		res, err = u.retryUnauthorized(req, header, res)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reads != nil && u.Debug {
+		stderr("%s read in %d reads of up to %d bytes, with a read buffer of %d bytes", fbody.Name(), reads.reads, reads.max, u.ReadBufferSize)
+	}
+
+	if u.completion != nil {
+		u.completion.etag = res.Header.Get("ETag")
+	}
+	if u.closed != nil {
+		*u.closed = res.Close && res.StatusCode == http.StatusOK
+	}
 
 	switch res.StatusCode {
-	case http.StatusOK:
-		return res.Body, nil
-	case http.StatusBadRequest:
-		return res.Body, nil
+	case http.StatusOK, http.StatusBadRequest:
+		body, err := decodeBody(res)
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		return body, nil
+	case http.StatusPreconditionFailed:
+		res.Body.Close()
+		return nil, errPreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return nil, quotaError(res)
 	default:
 		res.Body.Close()
-		return nil, fmt.Errorf("bad HTTP status code: %d", res.StatusCode)
+		return nil, statusError(res.StatusCode)
+	}
+
+}
+
+// context returns the context of the requests.
+func (u Uploader) context() context.Context {
+	if u.ctx == nil {
+		return context.Background()
+	}
+	return u.ctx
+}
+
+// sleep waits for d, or until the push is cancelled, in which case it
+// returns the error of its context.
+func (u Uploader) sleep(d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-u.context().Done():
+		return u.context().Err()
+	}
+}
+
+// httpClient returns the client to perform requests with.
+func (u Uploader) httpClient() *http.Client {
+	// The default transport is kept when there is no TLS, DNS or proxy
+	// tuning and no Unix socket, so that connections are reused across
+	// the requests.
+	transport := http.DefaultTransport
+	if tlsConfig := u.tlsConfig(); tlsConfig != nil || u.Resolver != "" || u.proxied() || u.unix {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		if u.Resolver != "" {
+			t.DialContext = u.dialContext()
+		}
+		if u.proxied() {
+			t.Proxy = u.proxy
+		}
+		if u.unix {
+			t.RegisterProtocol("unix", unixTransport{})
+		}
+		transport = t
+	}
+
+	if u.conns != nil {
+		transport = &connLimitTransport{transport, u}
+	}
+	client := &http.Client{Transport: transport}
+
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("too many redirects")
+		}
+		if via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme == "http" && !u.AllowInsecureRedirect {
+			return fmt.Errorf("refusing to follow https→http redirect to %s", req.URL)
+		}
+		// The client doesn't carry the trailers over to the redirected
+		// request, whose body sets them again.
+		req.Trailer = via[0].Trailer
+		return u.authorize(req)
+	}
+	return client
+}
+
+// tlsConfig returns the TLS configuration of the requests, or nil if the
+// defaults apply.
+func (u Uploader) tlsConfig() *tls.Config {
+	if !u.Insecure && u.TLSMinVersion == 0 && u.TLSMaxVersion == 0 && len(u.CertPins) == 0 {
+		return nil
 	}
+	c := &tls.Config{
+		InsecureSkipVerify: u.Insecure,
+		MinVersion:         u.TLSMinVersion,
+		MaxVersion:         u.TLSMaxVersion,
+	}
+	if len(u.CertPins) != 0 {
+		c.VerifyPeerCertificate = u.verifyCertPins
+	}
+	return c
+}
+
+// setHeaders adds the Uploader's and the given headers to the request,
+// followed by the authentication ones, and runs the Interceptors on it.
+func (u Uploader) setHeaders(req *http.Request, header http.Header) error {
+	for _, h := range []http.Header{u.Headers, header} {
+		for k, v := range h {
+			req.Header[k] = append(req.Header[k], v...)
+		}
+	}
+	return u.authorize(req)
+}
 
+// fileBody returns a request body reading the file from offset, mapped in
+// memory with Mmap, drawing a progress bar labelled bar if not empty, and
+// through a buffer of ReadBufferSize whose reads are counted by reads if not
+// nil.
+func (u Uploader) fileBody(f *os.File, offset int64, bar string, reads *readCounter) (io.ReadCloser, error) {
+	if _, err := f.Seek(offset, 0); err != nil {
+		return nil, err
+	}
+	// The transport closes the body once sent, which would keep the
+	// file from being sent again on redirects.
+	var src io.ReadCloser = ioutil.NopCloser(f)
+	if u.Mmap {
+		if m, err := mapFile(f, offset); err == nil {
+			src = m
+		} else if u.Debug {
+			stderr("reading %s instead of mapping it in memory: %v", f.Name(), err)
+		}
+	}
+	var body io.Reader = src
+	if bar != "" {
+		progress, err := u.genProgressBar(f, body, bar)
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+		body = progress
+	}
+	if reads != nil {
+		body = u.bufferBody(body, reads)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, src}, nil
 }
 
-func genProgressBar(file *os.File, label string) (io.Reader, error) {
+// genProgressBar returns a reader of r drawing the progress of its reads from
+// file.
+func (u Uploader) genProgressBar(file *os.File, r io.Reader, label string) (io.Reader, error) {
 	finfo, err := file.Stat()
 	if err != nil {
 		return nil, err
@@ -332,29 +2050,13 @@ func genProgressBar(file *os.File, label string) (io.Reader, error) {
 	} else {
 		prefix = "Uploading"
 	}
-	fmtBytesSize := 18
-	barSize := int64(80 - len(prefix) - fmtBytesSize)
-	bar := ioprogress.DrawTextFormatBarForW(barSize, os.Stderr)
-	fmtfunc := func(progress, total int64) string {
-		// Content-Length is set to -1 when unknown.
-		if total == -1 {
-			return fmt.Sprintf(
-				"%s: %v of an unknown total size",
-				prefix,
-				ioprogress.ByteUnitStr(progress),
-			)
-		}
-		return fmt.Sprintf(
-			"%s: %s %s",
-			prefix,
-			bar(progress, total),
-			ioprogress.DrawTextFormatBytes(progress, total),
-		)
+	if u.progressLines {
+		prefix = u.Uri + ": " + prefix
 	}
 	return &ioprogress.Reader{
-		Reader:       file,
+		Reader:       r,
 		Size:         finfo.Size(),
-		DrawFunc:     ioprogress.DrawTerminalf(os.Stderr, fmtfunc),
+		DrawFunc:     progressDrawFunc(prefix, u.progressLines),
 		DrawInterval: time.Second,
 	}, nil
 }
@@ -0,0 +1,69 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import "testing"
+
+func TestResolveURLs(t *testing.T) {
+	const initurl = "https://registry.example.com/push/init?name=app"
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"parts/aci", "https://registry.example.com/push/parts/aci"},
+		{"../x", "https://registry.example.com/x"},
+		{"/x", "https://registry.example.com/x"},
+		{"https://storage.example.com/aci?sig=1", "https://storage.example.com/aci?sig=1"},
+		{"//storage.example.com/aci", "https://storage.example.com/aci"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		d := &initiateDetails{
+			ManifestURL:  tt.url,
+			SignatureURL: tt.url,
+			ACIURL:       tt.url,
+			CompletedURL: tt.url,
+		}
+		if err := d.resolveURLs(initurl); err != nil {
+			t.Errorf("resolving %q: %v", tt.url, err)
+			continue
+		}
+		for name, got := range map[string]string{
+			"manifest":   d.ManifestURL,
+			"signature":  d.SignatureURL,
+			"aci":        d.ACIURL,
+			"completion": d.CompletedURL,
+		} {
+			if got != tt.want {
+				t.Errorf("%s URL %q resolved to %q, want %q", name, tt.url, got, tt.want)
+			}
+		}
+	}
+
+	// An empty CompletedURL means there is no completion, and stays
+	// empty while the other URLs are resolved.
+	d := &initiateDetails{ACIURL: "aci"}
+	if err := d.resolveURLs(initurl); err != nil {
+		t.Fatal(err)
+	}
+	if d.CompletedURL != "" || d.ACIURL != "https://registry.example.com/push/aci" {
+		t.Errorf("got completion URL %q and ACI URL %q", d.CompletedURL, d.ACIURL)
+	}
+
+	d = &initiateDetails{ACIURL: "%zz"}
+	if err := d.resolveURLs(initurl); err == nil {
+		t.Errorf("expected an error for an invalid URL, got %q", d.ACIURL)
+	}
+}
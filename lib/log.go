@@ -0,0 +1,113 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// byteMeter counts, and optionally digests, the bytes of a request body.
+type byteMeter struct {
+	n int64
+	h hash.Hash
+}
+
+func newByteMeter(digest bool) *byteMeter {
+	m := &byteMeter{}
+	if digest {
+		m.h = sha256.New()
+	}
+	return m
+}
+
+func (m *byteMeter) Write(p []byte) (int, error) {
+	m.n += int64(len(p))
+	if m.h == nil {
+		return len(p), nil
+	}
+	return m.h.Write(p)
+}
+
+func (m *byteMeter) digest() string {
+	return "sha256:" + hex.EncodeToString(m.h.Sum(nil))
+}
+
+// meter makes the meter count the body of the request, starting over if
+// the body is sent again.
+func (m *byteMeter) meter(req *http.Request) {
+	wrap := func(rc io.ReadCloser) io.ReadCloser {
+		m.n = 0
+		if m.h != nil {
+			m.h.Reset()
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(rc, m), rc}
+	}
+	if req.Body != nil {
+		req.Body = wrap(req.Body)
+	}
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return wrap(body), nil
+		}
+	}
+}
+
+// pushSummary collects what is logged about a push once it is over.
+type pushSummary struct {
+	endpoint  string
+	aciBytes  int64
+	aciDigest string
+}
+
+// logMu serializes the writes to Log, which may be shared by concurrent
+// pushes.
+var logMu sync.Mutex
+
+// logf writes a timestamped line to Log, if set.
+func (u Uploader) logf(format string, a ...interface{}) {
+	if u.Log == nil {
+		return
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprintf(u.Log, "%s %s\n", time.Now().UTC().Format(time.RFC3339), fmt.Sprintf(format, a...))
+}
+
+func (u Uploader) logResult(err error, d time.Duration) {
+	s := u.summary
+	endpoint := s.endpoint
+	if endpoint == "" {
+		endpoint = "unknown endpoint"
+	}
+	if err != nil {
+		u.logf("push of %s to %s failed after %v: %v", u.Uri, endpoint, d, err)
+		return
+	}
+	u.logf("push of %s to %s succeeded in %v, ACI %d bytes, %s", u.Uri, endpoint, d, s.aciBytes, s.aciDigest)
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/aci"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+)
+
+// ManifestError is returned when the manifest can't be read from the ACI to
+// push.
+type ManifestError struct {
+	// Path is the path of the ACI.
+	Path string
+	// NotACI is set when the file isn't an ACI at all, as opposed to an
+	// ACI whose manifest is invalid.
+	NotACI bool
+	// Err is the cause of the failure.
+	Err error
+}
+
+func (e *ManifestError) Error() string {
+	if !e.NotACI {
+		return fmt.Sprintf("invalid image manifest in %s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s is not a valid ACI: %v\n  hint: an ACI is a tar archive, optionally compressed with gzip, bzip2 or xz, holding the image manifest in a %s file", e.Path, e.Err, aci.ManifestFile)
+}
+
+// notACIError returns the error telling that the file isn't an ACI, for
+// the given reason.
+func notACIError(format string, args ...interface{}) *ManifestError {
+	return &ManifestError{NotACI: true, Err: fmt.Errorf(format, args...)}
+}
+
+// checkACIType returns an error unless typ is the type of an ACI.
+func checkACIType(typ aci.FileType) error {
+	switch typ {
+	case aci.TypeGzip, aci.TypeBzip2, aci.TypeXz, aci.TypeTar:
+		return nil
+	case aci.TypeText:
+		return notACIError("it is a text file")
+	default:
+		return notACIError("unknown file type")
+	}
+}
+
+// manifestFromImage works like aci.ManifestFromImage, but returns a
+// *ManifestError telling what is wrong with the ACI at path if the manifest
+// can't be read.
+func manifestFromImage(path string, rs io.ReadSeeker) (*schema.ImageManifest, error) {
+	manifest, err := readManifest(rs)
+	if e, ok := err.(*ManifestError); ok {
+		e.Path = path
+	}
+	return manifest, err
+}
+
+func readManifest(rs io.ReadSeeker) (*schema.ImageManifest, error) {
+	typ, err := aci.DetectFileType(rs)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkACIType(typ); err != nil {
+		return nil, err
+	}
+	tr, err := aci.NewCompressedTarReader(rs)
+	if err != nil {
+		return nil, notACIError("corrupt %s data: %v", typ, err)
+	}
+	defer tr.Close()
+	return readManifestEntry(tr.Reader)
+}
+
+// readManifestEntry reads the manifest from the tar archive of an ACI.
+func readManifestEntry(tr *tar.Reader) (*schema.ImageManifest, error) {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, notACIError("no %s file in the archive", aci.ManifestFile)
+		}
+		if err != nil {
+			return nil, notACIError("corrupt archive: %v", err)
+		}
+		if filepath.Clean(hdr.Name) != aci.ManifestFile {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, notACIError("corrupt archive: %v", err)
+		}
+		var im schema.ImageManifest
+		if err := im.UnmarshalJSON(data); err != nil {
+			return nil, &ManifestError{Err: err}
+		}
+		return &im, nil
+	}
+}
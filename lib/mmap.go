@@ -0,0 +1,72 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+)
+
+// mappedFile reads a file mapped in memory, which is unmapped once closed.
+type mappedFile struct {
+	mu   sync.Mutex
+	data []byte
+	r    *bytes.Reader
+}
+
+// mapFile maps the file in memory, to be read from offset.
+func mapFile(f *os.File, offset int64) (*mappedFile, error) {
+	finfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !finfo.Mode().IsRegular() || finfo.Size() == 0 {
+		return nil, errors.New("only non-empty regular files can be mapped")
+	}
+	data, err := mmap(f, finfo.Size())
+	if err != nil {
+		return nil, err
+	}
+	m := &mappedFile{data: data, r: bytes.NewReader(data)}
+	if _, err := m.r.Seek(offset, 0); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *mappedFile) Read(p []byte) (int, error) {
+	// The transport may close the body while another goroutine reads
+	// it, which mustn't read unmapped memory.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	return m.r.Read(p)
+}
+
+func (m *mappedFile) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return nil
+	}
+	err := munmap(m.data)
+	m.data = nil
+	return err
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// BenchmarkFileBody compares reading the parts from the files with reading
+// them mapped in memory, as done for Mmap.
+func BenchmarkFileBody(b *testing.B) {
+	const size = 64 << 20
+	f, err := ioutil.TempFile("", "acpush-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.CopyN(f, rand.New(rand.NewSource(1)), size); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bench := range []struct {
+		name string
+		u    Uploader
+	}{
+		{"read", Uploader{}},
+		{"mmap", Uploader{Mmap: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				body, err := bench.u.fileBody(f, 0, "", nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(ioutil.Discard, body)
+				body.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != size {
+					b.Fatalf("read %d bytes, want %d", n, size)
+				}
+			}
+		})
+	}
+}
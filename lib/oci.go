@@ -0,0 +1,302 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/discovery"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema/types"
+)
+
+const (
+	// FormatACI is the format of App Container Images.
+	FormatACI = "aci"
+	// FormatOCI is the format of OCI image layouts, either as a
+	// directory or as a tar archive of one.
+	FormatOCI = "oci"
+
+	ociExtension      = "oci"
+	ociIndexFile      = "index.json"
+	ociRefAnnotation  = "org.opencontainers.image.ref.name"
+	ociManifestMedia  = "application/vnd.oci.image.manifest.v1+json"
+	ociBlobsDirectory = "blobs"
+)
+
+// ociArchs maps OCI architecture names to their ACI counterparts, where they
+// differ.
+var ociArchs = map[string]string{
+	"386":   "i386",
+	"arm64": "aarch64",
+	"arm":   "armv7l",
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Config      ociDescriptor     `json:"config"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type ociConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// ociLayout reads files from an OCI image layout.
+type ociLayout interface {
+	readFile(name string) ([]byte, error)
+}
+
+type ociDirLayout string
+
+func (d ociDirLayout) readFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+type ociTarLayout struct {
+	f *os.File
+}
+
+func (t ociTarLayout) readFile(name string) ([]byte, error) {
+	if _, err := t.f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(t.f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in OCI image layout", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(hdr.Name, "./") == name {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+func readOCIJSON(layout ociLayout, name string, v interface{}) error {
+	blob, err := layout.readFile(name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(blob, v); err != nil {
+		return fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	return nil
+}
+
+func ociBlobPath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid digest: %q", digest)
+	}
+	return strings.Join([]string{ociBlobsDirectory, parts[0], parts[1]}, "/"), nil
+}
+
+// selectOCIManifest picks the manifest to push from the index. If the index
+// lists more than one image manifest, the os and arch labels of the app are
+// used to select one.
+func selectOCIManifest(index *ociIndex, app *discovery.App) (*ociDescriptor, error) {
+	var candidates []ociDescriptor
+	for _, m := range index.Manifests {
+		if m.MediaType == "" || m.MediaType == ociManifestMedia {
+			candidates = append(candidates, m)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("no image manifests found in OCI index")
+	case 1:
+		return &candidates[0], nil
+	}
+	os, osOk := app.Labels[osLabelName]
+	arch, archOk := app.Labels[archLabelName]
+	if !osOk || !archOk {
+		return nil, fmt.Errorf("OCI index lists %d image manifests, the os and arch labels are needed to select one", len(candidates))
+	}
+	for _, m := range candidates {
+		if m.Platform == nil || m.Platform.OS != os {
+			continue
+		}
+		if m.Platform.Architecture == arch || ociArchs[m.Platform.Architecture] == arch {
+			return &m, nil
+		}
+	}
+	return nil, fmt.Errorf("no image manifest for os %q and arch %q found in OCI index", os, arch)
+}
+
+// ociImageManifest reads the OCI manifest and config from the layout and
+// converts them into an ACI image manifest named after the app.
+func ociImageManifest(layout ociLayout, app *discovery.App) (*schema.ImageManifest, error) {
+	var index ociIndex
+	if err := readOCIJSON(layout, ociIndexFile, &index); err != nil {
+		return nil, err
+	}
+	desc, err := selectOCIManifest(&index, app)
+	if err != nil {
+		return nil, err
+	}
+	manifestPath, err := ociBlobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ociManifest
+	if err := readOCIJSON(layout, manifestPath, &manifest); err != nil {
+		return nil, err
+	}
+	configPath, err := ociBlobPath(manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var config ociConfig
+	if err := readOCIJSON(layout, configPath, &config); err != nil {
+		return nil, err
+	}
+
+	labels := make(map[types.ACIdentifier]string)
+	if config.OS != "" {
+		labels[osLabelName] = config.OS
+	}
+	if config.Architecture != "" {
+		arch := config.Architecture
+		if a, ok := ociArchs[arch]; ok {
+			arch = a
+		}
+		labels[archLabelName] = arch
+	}
+	if ref, ok := desc.Annotations[ociRefAnnotation]; ok {
+		labels["version"] = ref
+	}
+
+	im := schema.BlankImageManifest()
+	im.Name = app.Name
+	im.Labels, err = types.LabelsFromMap(labels)
+	if err != nil {
+		return nil, err
+	}
+	// OCI annotation keys that aren't valid AC identifiers have no
+	// ACI equivalent and are dropped.
+	for k, v := range manifest.Annotations {
+		name, err := types.NewACIdentifier(k)
+		if err != nil {
+			continue
+		}
+		im.Annotations.Set(*name, v)
+	}
+	return im, nil
+}
+
+// openOCIImage reads the manifest of the OCI image layout at path, which is
+// either a directory or a tar archive, and returns it along with a reader of
+// the image as a tar archive.
+func openOCIImage(path string, app *discovery.App) (*schema.ImageManifest, io.ReadCloser, error) {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if finfo.IsDir() {
+		manifest, err := ociImageManifest(ociDirLayout(path), app)
+		if err != nil {
+			return nil, nil, err
+		}
+		return manifest, tarDir(path), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := ociImageManifest(ociTarLayout{f}, app)
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return manifest, f, nil
+}
+
+// tarDir streams a tar archive of the given directory.
+func tarDir(dir string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+			link := ""
+			if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
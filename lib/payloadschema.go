@@ -0,0 +1,92 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/xeipuuv/gojsonschema"
+)
+
+// payloadKinds are the payloads validated against the schemas, named after
+// the members of the PayloadSchema document holding their schema.
+var payloadKinds = []string{"initiation", "completion"}
+
+// payloadSchemas are the compiled schemas of the payloads sent to the
+// server, by kind.
+type payloadSchemas map[string]*gojsonschema.Schema
+
+// loadPayloadSchemas reads and compiles the schemas of the payloads from the
+// given file.
+func loadPayloadSchemas(path string) (payloadSchemas, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the payload schema: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(blob, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing the payload schema %s: %v", path, err)
+	}
+	schemas := make(payloadSchemas)
+	for _, kind := range payloadKinds {
+		if _, ok := doc[kind]; !ok {
+			continue
+		}
+		// The schema of the payload is compiled as a reference from
+		// the whole document, for the references between its
+		// members to resolve.
+		root := make(map[string]interface{}, len(doc)+1)
+		for k, v := range doc {
+			root[k] = v
+		}
+		root["$ref"] = "#/" + kind
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(root))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s schema in %s: %v", kind, path, err)
+		}
+		schemas[kind] = schema
+	}
+	if len(schemas) == 0 {
+		return nil, fmt.Errorf("the payload schema %s has neither an initiation nor a completion schema", path)
+	}
+	return schemas, nil
+}
+
+// validatePayload checks the JSON payload of the given kind, initiation or
+// completion, against its schema, if any.
+func (u Uploader) validatePayload(kind string, blob []byte) error {
+	schema, ok := u.schemas[kind]
+	if !ok {
+		return nil
+	}
+	res, err := schema.Validate(gojsonschema.NewBytesLoader(blob))
+	if err != nil {
+		return fmt.Errorf("error validating the %s payload: %v", kind, err)
+	}
+	if !res.Valid() {
+		var errs []string
+		for _, e := range res.Errors() {
+			errs = append(errs, e.String())
+		}
+		return fmt.Errorf("the %s payload doesn't match the schema: %s", kind, strings.Join(errs, "; "))
+	}
+	if u.Debug {
+		stderr("the %s payload matches the schema", kind)
+	}
+	return nil
+}
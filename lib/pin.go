@@ -0,0 +1,70 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// checkCertPins makes sure every pin of CertPins is a SHA-256 digest.
+func (u Uploader) checkCertPins() error {
+	for _, pin := range u.CertPins {
+		if _, err := certPin(pin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// certPin decodes a hex SHA-256 digest, which may be written with colons
+// between the bytes as openssl prints the fingerprints.
+func certPin(pin string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid certificate pin %q: not a hex SHA-256 digest", pin)
+	}
+	return b, nil
+}
+
+// verifyCertPins is the VerifyPeerCertificate callback of the TLS
+// connections when CertPins is set. It accepts the connection if the digest
+// of the leaf certificate's public key, or of the whole leaf certificate,
+// matches one of the pins. It is called after the chain has been verified,
+// so a pinned certificate still has to be trusted unless Insecure is set.
+func (u Uploader) verifyCertPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("the server presented no certificate to check the pins against")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("error parsing the server certificate: %v", err)
+	}
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	cert := sha256.Sum256(leaf.Raw)
+	for _, pin := range u.CertPins {
+		b, err := certPin(pin)
+		if err != nil {
+			return err
+		}
+		if string(b) == string(spki[:]) || string(b) == string(cert[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the server certificate matches none of the pins, its public key digest is %x", spki)
+}
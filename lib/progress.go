@@ -0,0 +1,176 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/coreos/ioprogress"
+	"github.com/appc/acpush/Godeps/_workspace/src/golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// progressStep is the percentage of progress between two lines of
+	// the line based progress.
+	progressStep = 10
+
+	// rateWindow is the period over which the transfer rate shown with
+	// the bar is averaged, once at least minRateWindow has elapsed.
+	rateWindow    = 5 * time.Second
+	minRateWindow = time.Second / 2
+
+	// minBarWidth is the narrowest the progress bar is drawn.
+	minBarWidth = 10
+)
+
+// progressDrawFunc returns the function drawing the progress of an upload
+// to stderr: a bar redrawn in place on terminals, or a line every
+// progressStep percent otherwise, such as in CI logs, or if lines is set.
+func progressDrawFunc(prefix string, lines bool) ioprogress.DrawFunc {
+	if lines || !terminal.IsTerminal(int(os.Stderr.Fd())) {
+		return lineProgress(prefix)
+	}
+
+	width := 80
+	if runtime.GOOS == "windows" {
+		// Windows consoles wrap lines reaching the last column,
+		// which would make every redraw start a new line.
+		width = 79
+	}
+	return ioprogress.DrawTerminalf(os.Stderr, barFormat(prefix, width))
+}
+
+// barFormat returns the function formatting the progress bar line of an
+// upload, fitting in width columns. The rate and the time remaining are left
+// out when there is no room for them, and the bar is kept at minBarWidth
+// even if the line then overflows, for prefixes too long.
+func barFormat(prefix string, width int) func(progress, total int64) string {
+	fmtBytesSize := 18
+	// Room for the rate and the time remaining, e.g. " 1.23 MB/s ETA 1:02:03".
+	fmtRateSize := 24
+	barWidth := width - len(prefix) - fmtBytesSize - fmtRateSize
+	showRate := barWidth >= minBarWidth
+	if !showRate {
+		barWidth += fmtRateSize
+	}
+	if barWidth < minBarWidth {
+		barWidth = minBarWidth
+	}
+	bar := ioprogress.DrawTextFormatBar(int64(barWidth))
+	rate := &rateMeter{}
+	return func(progress, total int64) string {
+		bps := rate.update(progress)
+		// Content-Length is set to -1 when unknown.
+		if total == -1 {
+			return fmt.Sprintf(
+				"%s: %v of an unknown total size, %s",
+				prefix,
+				ioprogress.ByteUnitStr(progress),
+				formatRate(bps),
+			)
+		}
+		if !showRate {
+			return fmt.Sprintf(
+				"%s: %s %s",
+				prefix,
+				bar(progress, total),
+				ioprogress.DrawTextFormatBytes(progress, total),
+			)
+		}
+		return fmt.Sprintf(
+			"%s: %s %s %9s ETA %8s",
+			prefix,
+			bar(progress, total),
+			ioprogress.DrawTextFormatBytes(progress, total),
+			formatRate(bps),
+			formatETA(total-progress, bps),
+		)
+	}
+}
+
+// rateMeter computes the transfer rate over the last rateWindow from the
+// progress reported to it.
+type rateMeter struct {
+	samples []rateSample
+}
+
+type rateSample struct {
+	at       time.Time
+	progress int64
+}
+
+// update records the progress and returns the transfer rate, in bytes per
+// second, or -1 if not enough time has elapsed to compute it.
+func (m *rateMeter) update(progress int64) float64 {
+	now := time.Now()
+	m.samples = append(m.samples, rateSample{now, progress})
+	for len(m.samples) > 2 && now.Sub(m.samples[1].at) >= rateWindow {
+		m.samples = m.samples[1:]
+	}
+	first := m.samples[0]
+	elapsed := now.Sub(first.at)
+	if elapsed < minRateWindow {
+		return -1
+	}
+	return float64(progress-first.progress) / elapsed.Seconds()
+}
+
+func formatRate(bps float64) string {
+	if bps < 0 {
+		return "--/s"
+	}
+	return ioprogress.ByteUnitStr(int64(bps)) + "/s"
+}
+
+// formatETA returns the time needed to send the remaining bytes at the
+// given rate, or "--:--" if it can't be estimated.
+func formatETA(remaining int64, bps float64) string {
+	if bps <= 0 {
+		return "--:--"
+	}
+	eta := time.Duration(float64(remaining) / bps * float64(time.Second))
+	if eta >= 100*time.Hour {
+		return "--:--"
+	}
+	secs := int64(eta.Seconds() + 0.5)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+func lineProgress(prefix string) ioprogress.DrawFunc {
+	last := -1
+	return func(progress, total int64) error {
+		// Sent once done, to end the line of terminal bars.
+		if progress == -1 && total == -1 {
+			return nil
+		}
+		if total <= 0 {
+			return nil
+		}
+		percent := int(progress * 100 / total)
+		step := percent - percent%progressStep
+		if step == last {
+			return nil
+		}
+		last = step
+		_, err := fmt.Fprintf(os.Stderr, "%s: %d%% (%s)\n", prefix, step, ioprogress.DrawTextFormatBytes(progress, total))
+		return err
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBarFormatLongPrefix(t *testing.T) {
+	for _, prefix := range []string{
+		"Uploading ACI",
+		"Uploading ACI (restarted after redirect)",
+		strings.Repeat("x", 100),
+	} {
+		format := barFormat(prefix, 80)
+		for _, progress := range []int64{0, 512, 1024} {
+			line := format(progress, 1024)
+			if !strings.HasPrefix(line, prefix+": [") {
+				t.Errorf("line %q has no bar after its prefix", line)
+			}
+			if len(prefix) <= 40 && len(line) > 80 {
+				t.Errorf("line %q overflows 80 columns", line)
+			}
+		}
+		if line := format(512, -1); !strings.Contains(line, "unknown total size") {
+			t.Errorf("unexpected line for an unknown size: %q", line)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxied reports whether the proxy of the requests is configured.
+func (u Uploader) proxied() bool {
+	return u.Proxy != "" || u.ProxyAuth != "" || u.SOCKS5 != ""
+}
+
+// proxy returns the URL of the proxy to send the request through, SOCKS5,
+// Proxy or the one of the environment, with the ProxyAuth credentials.
+func (u Uploader) proxy(req *http.Request) (*url.URL, error) {
+	var (
+		proxyURL *url.URL
+		err      error
+	)
+	if u.SOCKS5 != "" {
+		// The http package dials socks5 proxies itself, with the
+		// host names left for the proxy to resolve.
+		if proxyURL, err = socks5URL(u.SOCKS5); err != nil {
+			return nil, err
+		}
+	} else if u.Proxy != "" {
+		if proxyURL, err = url.Parse(u.Proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %v", u.Proxy, err)
+		}
+	} else if proxyURL, err = http.ProxyFromEnvironment(req); err != nil || proxyURL == nil {
+		return proxyURL, err
+	}
+	if u.ProxyAuth != "" {
+		user, password, err := splitProxyAuth(u.ProxyAuth)
+		if err != nil {
+			return nil, err
+		}
+		// The URL is copied as the one from the environment is
+		// cached by the http package.
+		withAuth := *proxyURL
+		withAuth.User = url.UserPassword(user, password)
+		proxyURL = &withAuth
+	}
+	return proxyURL, nil
+}
+
+// socks5URL returns the proxy URL of a SOCKS5 proxy given as
+// [user:password@]host:port.
+func socks5URL(addr string) (*url.URL, error) {
+	proxyURL := &url.URL{Scheme: "socks5", Host: addr}
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		user, password, err := splitProxyAuth(addr[:i])
+		if err != nil {
+			return nil, err
+		}
+		proxyURL.User = url.UserPassword(user, password)
+		proxyURL.Host = addr[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(proxyURL.Host); err != nil {
+		return nil, fmt.Errorf("invalid SOCKS5 proxy %q, expected host:port", proxyURL.Host)
+	}
+	return proxyURL, nil
+}
+
+// splitProxyAuth splits proxy credentials given as user:password.
+func splitProxyAuth(auth string) (string, string, error) {
+	parts := strings.SplitN(auth, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("invalid proxy credentials, expected user:password")
+	}
+	return parts[0], parts[1], nil
+}
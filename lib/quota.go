@@ -0,0 +1,74 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// sizeHeader is the header of the initiation request carrying the size of
+// the ACI with SendSize.
+const sizeHeader = "X-ACI-Size"
+
+// QuotaError is returned when the server refuses the image for its size,
+// replying with a 413 status.
+type QuotaError struct {
+	// Size is the size of the image, and Quota the most the server
+	// accepts, 0 when not known.
+	Size  int64
+	Quota int64
+	// Reason is the explanation of the server, if any.
+	Reason string
+}
+
+func (e *QuotaError) Error() string {
+	msg := "server refused: image exceeds quota"
+	switch {
+	case e.Size > 0 && e.Quota > 0:
+		msg = fmt.Sprintf("%s (%d of %d bytes)", msg, e.Size, e.Quota)
+	case e.Quota > 0:
+		msg = fmt.Sprintf("%s (of %d bytes)", msg, e.Quota)
+	case e.Size > 0:
+		msg = fmt.Sprintf("%s (%d bytes)", msg, e.Size)
+	}
+	if e.Reason != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Reason)
+	}
+	return msg
+}
+
+// quotaReply is the optional JSON body of a 413 reply.
+type quotaReply struct {
+	Size   int64  `json:"size"`
+	Quota  int64  `json:"quota"`
+	Reason string `json:"reason"`
+}
+
+// quotaError returns the error of a 413 reply, telling what the server
+// said of the size and quota when it did.
+func quotaError(res *http.Response) *QuotaError {
+	var reply quotaReply
+	if body, err := decodeBody(res); err == nil {
+		// Replies that aren't JSON carry no details.
+		json.NewDecoder(io.LimitReader(body, 1<<20)).Decode(&reply)
+		body.Close()
+	} else {
+		res.Body.Close()
+	}
+	return &QuotaError{Size: reply.Size, Quota: reply.Quota, Reason: reply.Reason}
+}
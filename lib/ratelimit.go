@@ -0,0 +1,151 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of the bytes sent to a host, with bursts of
+// up to a second worth of them.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// burst returns the most bytes that may be sent at once.
+func (b *tokenBucket) burst() int {
+	return int(b.rate)
+}
+
+// wait takes n bytes from the bucket, waiting for them to be available.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimiters holds the token buckets of the hosts, shared by the pushes
+// of UploadMirror.
+type rateLimiters struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// rateLimiter returns the token bucket limiting the uploads to host, or nil
+// if they aren't limited.
+func (u Uploader) rateLimiter(host string) *tokenBucket {
+	rate, ok := u.HostRateLimits[host]
+	if !ok {
+		rate = u.RateLimit
+	}
+	if rate <= 0 || u.limiters == nil {
+		return nil
+	}
+	u.limiters.mu.Lock()
+	defer u.limiters.mu.Unlock()
+	b, ok := u.limiters.buckets[host]
+	if !ok {
+		b = newTokenBucket(rate)
+		u.limiters.buckets[host] = b
+	}
+	return b
+}
+
+// withRateLimiters returns the Uploader with the token buckets its pushes
+// share, creating them if it has none yet.
+func (u Uploader) withRateLimiters() Uploader {
+	if u.limiters == nil && (u.RateLimit > 0 || len(u.HostRateLimits) > 0) {
+		u.limiters = &rateLimiters{buckets: make(map[string]*tokenBucket)}
+	}
+	return u
+}
+
+// limitBody limits the rate at which the body of the request is sent to the
+// rate of its host.
+func (u Uploader) limitBody(req *http.Request) {
+	b := u.rateLimiter(req.URL.Host)
+	if b == nil || req.Body == nil {
+		return
+	}
+	wrap := func(rc io.ReadCloser) io.ReadCloser {
+		return &limitedBody{rc, b, req.Context()}
+	}
+	req.Body = wrap(req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			rc, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return wrap(rc), nil
+		}
+	}
+}
+
+// limitedBody reads its body no faster than its token bucket allows.
+type limitedBody struct {
+	rc  io.ReadCloser
+	b   *tokenBucket
+	ctx context.Context
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if burst := l.b.burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := l.rc.Read(p)
+	if n > 0 {
+		if werr := l.b.wait(l.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.rc.Close()
+}
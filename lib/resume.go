@@ -0,0 +1,116 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedCompletion holds what is needed to complete an upload whose parts
+// were all uploaded, but whose completion failed.
+type savedCompletion struct {
+	CompletedURL   string    `json:"completed_url"`
+	InitHost       string    `json:"init_host"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	Saved          time.Time `json:"saved"`
+}
+
+// completionState maps URIs to their saved completion.
+type completionState map[string]savedCompletion
+
+func readCompletionState(path string) (completionState, error) {
+	state := make(completionState)
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func writeCompletionState(path string, state completionState) error {
+	blob, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(blob, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// saveCompletion records the completion of the upload in the
+// CompletionStateFile, for ResumeCompletion to retry it.
+func (u Uploader) saveCompletion(completedURL string) error {
+	state, err := readCompletionState(u.CompletionStateFile)
+	if err != nil {
+		return err
+	}
+	state[u.Uri] = savedCompletion{
+		CompletedURL:   completedURL,
+		InitHost:       u.initHost,
+		IdempotencyKey: u.idempotencyKey,
+		Saved:          time.Now(),
+	}
+	return writeCompletionState(u.CompletionStateFile, state)
+}
+
+// resumeCompletion retries the saved completion of the upload, if any. It
+// reports whether the upload was completed; if the saved completion isn't
+// valid anymore, it is dropped for the image to be pushed again.
+func (u Uploader) resumeCompletion() (bool, error) {
+	state, err := readCompletionState(u.CompletionStateFile)
+	if err != nil {
+		return false, err
+	}
+	saved, ok := state[u.Uri]
+	if !ok {
+		if u.Debug {
+			stderr("no saved completion for %s, pushing it", u.Uri)
+		}
+		return false, nil
+	}
+	if u.Debug {
+		stderr("resuming the completion saved %s ago", time.Since(saved.Saved))
+	}
+	u.initHost = saved.InitHost
+	if saved.IdempotencyKey != "" {
+		u.idempotencyKey = saved.IdempotencyKey
+	}
+	completeErr := u.reportSuccess(saved.CompletedURL)
+	if completeErr != nil {
+		stderr("saved completion failed, pushing again: %v", completeErr)
+	} else {
+		u.sendEvent(UploadEvent{Kind: CompletionComplete, URL: saved.CompletedURL})
+	}
+	delete(state, u.Uri)
+	if err := writeCompletionState(u.CompletionStateFile, state); err != nil {
+		return false, err
+	}
+	return completeErr == nil, nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// savedSession holds what is needed to continue an upload from another
+// process: the response to its initiation, the tus uploads created for its
+// parts and the parts uploaded already.
+type savedSession struct {
+	Details        initiateDetails `json:"details"`
+	InitHost       string          `json:"init_host"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	// ImageSize and ImageModTime identify the image uploaded, so that
+	// the session isn't resumed once it changed.
+	ImageSize    int64     `json:"image_size"`
+	ImageModTime time.Time `json:"image_mod_time"`
+	// Uploads are the URLs of the tus uploads created, by part.
+	Uploads map[string]string `json:"uploads,omitempty"`
+	// Done lists the parts uploaded completely.
+	Done  []string  `json:"done,omitempty"`
+	Saved time.Time `json:"saved"`
+}
+
+// sessionState maps URIs to their saved session.
+type sessionState map[string]savedSession
+
+// sessionStateMu serializes the updates of the session file by the pushes
+// of UploadMirror.
+var sessionStateMu sync.Mutex
+
+func readSessionState(path string) (sessionState, error) {
+	state := make(sessionState)
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return state, nil
+}
+
+func writeSessionState(path string, state sessionState) error {
+	blob, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(blob, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// savesSession reports whether the session of the upload is saved to
+// SessionFile. It isn't for images which can't be read again the same, read
+// from stdin, a URL or a pipe, or built from a directory. The staged copies
+// of the images of stdin and URLs are new files for every push, which a
+// session saved couldn't be resumed for.
+func (u Uploader) savesSession() bool {
+	if u.SessionFile == "" || u.PrintRequests || u.Format == FormatACIDir || u.isStaged || u.Acipath == "-" {
+		return false
+	}
+	fi, err := os.Stat(u.Acipath)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// imageStamp returns the size and modification time of the image.
+func (u Uploader) imageStamp() (int64, time.Time, error) {
+	fi, err := os.Stat(u.Acipath)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return fi.Size(), fi.ModTime(), nil
+}
+
+// resumedSession returns the session saved for Uri, or nil if there is none
+// or the image changed since it was saved, in which case it is dropped.
+func (u Uploader) resumedSession() (*savedSession, error) {
+	sessionStateMu.Lock()
+	state, err := readSessionState(u.SessionFile)
+	sessionStateMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	saved, ok := state[u.Uri]
+	if !ok {
+		if u.Debug {
+			stderr("no saved session for %s, pushing it", u.Uri)
+		}
+		return nil, nil
+	}
+	size, modTime, err := u.imageStamp()
+	if err != nil {
+		return nil, err
+	}
+	if size != saved.ImageSize || !modTime.Equal(saved.ImageModTime) {
+		if u.Debug {
+			stderr("image changed since the session was saved, pushing it again")
+		}
+		u.dropSession()
+		return nil, nil
+	}
+	if u.Debug {
+		stderr("resuming the session saved %s ago, with %d parts uploaded", time.Since(saved.Saved), len(saved.Done))
+	}
+	if saved.Uploads == nil {
+		saved.Uploads = make(map[string]string)
+	}
+	return &saved, nil
+}
+
+// newSession returns the session of the upload initiated with details,
+// saved to SessionFile.
+func (u Uploader) newSession(details *initiateDetails) *savedSession {
+	size, modTime, err := u.imageStamp()
+	if err != nil {
+		u.warnf("error saving the upload session: %v", err)
+		return nil
+	}
+	u.session = &savedSession{
+		Details:        *details,
+		InitHost:       u.initHost,
+		IdempotencyKey: u.idempotencyKey,
+		ImageSize:      size,
+		ImageModTime:   modTime,
+		Uploads:        make(map[string]string),
+	}
+	u.saveSession()
+	return u.session
+}
+
+// sessionUpload returns the URL of the tus upload of the part saved in the
+// session, if any.
+func (u Uploader) sessionUpload(label string) string {
+	if u.session == nil {
+		return ""
+	}
+	return u.session.Uploads[label]
+}
+
+// sessionDone reports whether the part was uploaded completely in the
+// session.
+func (u Uploader) sessionDone(label string) bool {
+	if u.session == nil {
+		return false
+	}
+	for _, done := range u.session.Done {
+		if done == label {
+			return true
+		}
+	}
+	return false
+}
+
+// recordUpload saves the URL of the tus upload created for the part.
+func (u Uploader) recordUpload(label, location string) {
+	if u.session == nil {
+		return
+	}
+	u.session.Uploads[label] = location
+	u.saveSession()
+}
+
+// recordDone saves that the part was uploaded completely.
+func (u Uploader) recordDone(label string) {
+	if u.session == nil {
+		return
+	}
+	u.session.Done = append(u.session.Done, label)
+	delete(u.session.Uploads, label)
+	u.saveSession()
+}
+
+func (u Uploader) saveSession() {
+	u.session.Saved = time.Now()
+	saved := *u.session
+	u.updateSessions(func(state sessionState) { state[u.Uri] = saved })
+}
+
+func (u Uploader) dropSession() {
+	u.updateSessions(func(state sessionState) { delete(state, u.Uri) })
+}
+
+// updateSessions applies update to the sessions saved in SessionFile.
+// Failures only cost the ability to resume, so they are warned about.
+func (u Uploader) updateSessions(update func(sessionState)) {
+	sessionStateMu.Lock()
+	defer sessionStateMu.Unlock()
+	state, err := readSessionState(u.SessionFile)
+	if err != nil {
+		u.warnf("error saving the upload session: %v", err)
+		return
+	}
+	update(state)
+	if err := writeSessionState(u.SessionFile, state); err != nil {
+		u.warnf("error saving the upload session: %v", err)
+	}
+}
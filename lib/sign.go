@@ -0,0 +1,55 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// signature opens the signature to upload: the file at Ascpath, or the one
+// made with Sign if Ascpath is empty.
+func (u Uploader) signature() (io.ReadCloser, error) {
+	if u.Ascpath != "" || u.Sign == nil {
+		return os.Open(u.Ascpath)
+	}
+	if u.Streaming || u.Compress != "" || (u.Format != "" && u.Format != FormatACI) {
+		return nil, errors.New("the image can only be signed when pushed as is from an ACI file, neither streamed nor compressed while uploading it")
+	}
+	f, err := os.Open(u.Acipath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if u.Debug {
+		stderr("signing %s", u.Acipath)
+	}
+	sig, err := u.Sign(f)
+	if err != nil {
+		return nil, fmt.Errorf("error signing the image: %v", err)
+	}
+	return signatureReader{bytes.NewReader(sig)}, nil
+}
+
+// signatureReader is a signature made with Sign. It is seekable, like the
+// signature files, so that it can be digested and sent again.
+type signatureReader struct {
+	*bytes.Reader
+}
+
+func (signatureReader) Close() error { return nil }
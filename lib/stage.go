@@ -0,0 +1,130 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// needsStaging reports whether the image at Acipath is to be copied to a
+// temporary file before being pushed: when it is read from stdin without
+// Streaming, or fetched from an http or https URL.
+func (u Uploader) needsStaging() bool {
+	if u.Format == FormatACIDir {
+		return false
+	}
+	if u.Acipath == "-" {
+		return !u.Streaming
+	}
+	return strings.HasPrefix(u.Acipath, "http://") || strings.HasPrefix(u.Acipath, "https://")
+}
+
+// checkTempDir checks that the staging directory exists and is writable.
+func checkTempDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("invalid temp dir: %v", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("invalid temp dir: %s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, "acpush-check-")
+	if err != nil {
+		return fmt.Errorf("temp dir %s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// staged returns the uploader with the image at Acipath copied to a
+// temporary file in TempDir, or the default temp dir, if it needs staging.
+// The returned function removes the staged file, and must be called once
+// the image was pushed.
+func (u Uploader) staged() (Uploader, func(), error) {
+	if u.TempDir != "" {
+		if err := checkTempDir(u.TempDir); err != nil {
+			return u, nil, err
+		}
+	}
+	if !u.needsStaging() {
+		return u, func() {}, nil
+	}
+
+	src, err := u.stagingSource()
+	if err != nil {
+		return u, nil, err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(u.TempDir, "acpush-stage-")
+	if err != nil {
+		return u, nil, fmt.Errorf("error staging the image: %v", err)
+	}
+	remove := func() {
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			stderr("error removing the staged image: %v", err)
+		}
+	}
+	n, err := io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return u, nil, fmt.Errorf("error staging the image: %v", err)
+	}
+	if u.Debug {
+		stderr("staged %s to %s, %d bytes", u.Acipath, tmp.Name(), n)
+	}
+	u.Acipath = tmp.Name()
+	u.isStaged = true
+	return u, remove, nil
+}
+
+// stagingSource opens the image to stage, stdin or the body of the response
+// to a GET of its URL.
+func (u Uploader) stagingSource() (io.ReadCloser, error) {
+	if u.Acipath == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	req, err := http.NewRequestWithContext(u.context(), "GET", u.Acipath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.setHeaders(req, nil); err != nil {
+		return nil, err
+	}
+	res, err := u.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching the image: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("error fetching the image from %s: bad HTTP status code: %d", u.Acipath, res.StatusCode)
+	}
+	return res.Body, nil
+}
+
+// Stage returns the uploader with the image copied to a temporary file if
+// it is read from stdin or fetched from a URL, so that it can be read
+// before being pushed, by ManifestURI for one. The returned function
+// removes the staged file.
+func (u Uploader) Stage() (Uploader, func(), error) {
+	return u.staged()
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/aci"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+)
+
+// streamedImage is an image read from a stream which can't be rewound.
+type streamedImage struct {
+	io.Reader
+	io.Closer
+	typ aci.FileType
+}
+
+// openStreamedACI reads the manifest from the start of the ACI at path, or
+// from stdin if path is "-", without seeking. The bytes read up to the
+// manifest are buffered, and replayed by the returned reader before the
+// rest of the stream.
+func openStreamedACI(path string) (*schema.ImageManifest, io.ReadCloser, error) {
+	f := os.Stdin
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	manifest, image, err := readStreamedManifest(f)
+	if err != nil {
+		f.Close()
+		if e, ok := err.(*ManifestError); ok {
+			e.Path = path
+		}
+		return nil, nil, err
+	}
+	return manifest, image, nil
+}
+
+func readStreamedManifest(f *os.File) (*schema.ImageManifest, io.ReadCloser, error) {
+	br := bufio.NewReader(f)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	typ, err := aci.DetectFileType(bytes.NewReader(head))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkACIType(typ); err != nil {
+		return nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	tee := io.TeeReader(br, &buf)
+	var dr io.Reader
+	switch typ {
+	case aci.TypeGzip:
+		gr, err := gzip.NewReader(tee)
+		if err != nil {
+			return nil, nil, notACIError("corrupt %s data: %v", typ, err)
+		}
+		dr = gr
+	case aci.TypeBzip2:
+		dr = bzip2.NewReader(tee)
+	case aci.TypeTar:
+		dr = tee
+	case aci.TypeXz:
+		// The xz reader keeps reading from its input in the
+		// background, so the buffer couldn't be replayed reliably.
+		return nil, nil, errors.New("xz compressed images can't be streamed")
+	}
+
+	manifest, err := readManifestEntry(tar.NewReader(dr))
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, &streamedImage{io.MultiReader(&buf, br), f, typ}, nil
+}
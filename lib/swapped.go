@@ -0,0 +1,79 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/aci"
+)
+
+// checkSwapped fails if the image looks like a signature or the signature
+// like an image, as when the two arguments were given the wrong way round,
+// before anything is uploaded. Streamed images are read once, so nothing is
+// checked then.
+func (u Uploader) checkSwapped() error {
+	if u.Streaming {
+		return nil
+	}
+	if u.Format != FormatACIDir && u.Acipath != "-" {
+		head, err := peekFile(u.Acipath)
+		if err != nil {
+			// The error is reported once the image is opened.
+			return nil
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(head), armoredSignature) || isSignaturePacket(head) {
+			return fmt.Errorf("%s is a signature, not an image: it looks like the ACI and signature arguments may be swapped", u.Acipath)
+		}
+	}
+	if u.Ascpath != "" {
+		head, err := peekFile(u.Ascpath)
+		if err != nil {
+			return nil
+		}
+		switch typ, _ := aci.DetectFileType(bytes.NewReader(head)); typ {
+		case aci.TypeGzip, aci.TypeBzip2, aci.TypeXz, aci.TypeTar:
+			return fmt.Errorf("%s is a %s archive, not a signature: it looks like the ACI and signature arguments may be swapped", u.Ascpath, typ)
+		}
+	}
+	return nil
+}
+
+// peekFile returns the first bytes of the file at path, enough to detect
+// its type. It fails for anything but a regular file, as the bytes read from
+// a pipe or a device would be lost to the push.
+func peekFile(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
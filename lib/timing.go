@@ -0,0 +1,119 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestTiming collects the durations of the phases of a request. Every
+// request sent for a redirect restarts the collection.
+type requestTiming struct {
+	mu     sync.Mutex
+	method string
+	phases
+}
+
+type phases struct {
+	hostPort string
+	reused   bool
+
+	start, dnsStart, connectStart, tlsStart time.Time
+
+	dns, connect, tls, wrote time.Duration
+}
+
+// withTimingTrace returns a context logging the phase durations of the
+// requests made with it.
+func withTimingTrace(ctx context.Context, method string) context.Context {
+	t := &requestTiming{method: method}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.phases = phases{hostPort: hostPort, start: time.Now()}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.reused = info.Reused
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dns = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connect = time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tls = time.Since(t.tlsStart)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.wrote = time.Since(t.start)
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			stderr("timing: %s", t.summary(time.Since(t.start)))
+		},
+	})
+}
+
+func (t *requestTiming) summary(firstByte time.Duration) string {
+	out := []string{fmt.Sprintf("%s %s", t.method, t.hostPort)}
+	if t.reused {
+		out = append(out, "reused connection")
+	} else {
+		if !t.dnsStart.IsZero() {
+			out = append(out, fmt.Sprintf("dns %v", t.dns))
+		}
+		out = append(out, fmt.Sprintf("connect %v", t.connect))
+		if !t.tlsStart.IsZero() {
+			out = append(out, fmt.Sprintf("tls %v", t.tls))
+		}
+	}
+	return strings.Join(append(out,
+		fmt.Sprintf("request sent %v", t.wrote),
+		fmt.Sprintf("first byte %v", firstByte),
+	), ", ")
+}
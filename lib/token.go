@@ -0,0 +1,239 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Challenge is an authentication challenge of a WWW-Authenticate header,
+// such as Bearer realm="https://auth.example.com/token",service="example".
+type Challenge struct {
+	// Scheme is the authentication scheme, such as Bearer.
+	Scheme string
+	// Params are the parameters of the challenge, by lower case name.
+	Params map[string]string
+}
+
+// TokenAcquirer gets the bearer tokens asked for by the Bearer challenges
+// of registries rejecting requests with a 401, as with the token flow of
+// the Docker registry. The tokens acquired are cached for the push, and
+// acquired again when they are rejected.
+type TokenAcquirer interface {
+	// AcquireToken returns a token to authenticate to host with, as
+	// asked for by the challenge. The requests needed for it are sent
+	// with client, which has the TLS and proxy settings of the push.
+	AcquireToken(client *http.Client, host string, challenge Challenge) (string, error)
+}
+
+// DockerTokenAcquirer acquires tokens with the token flow of the Docker
+// registry: the token is fetched with a GET request to the realm of the
+// challenge, for its service and scope.
+type DockerTokenAcquirer struct {
+	// Authorize, if set, adds the credentials of host, the registry, to
+	// the request fetching its token. They are only added if the realm is
+	// on the registry host, unless ForeignRealmAuth is set.
+	Authorize func(host string, req *http.Request)
+	// ForeignRealmAuth permits sending the credentials of the registry
+	// to a realm on another host.
+	ForeignRealmAuth bool
+	// Insecure permits http realms.
+	Insecure bool
+}
+
+// dockerToken is the response of the realm of a Docker token flow, which
+// holds the token in either field.
+type dockerToken struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+func (a *DockerTokenAcquirer) AcquireToken(client *http.Client, host string, c Challenge) (string, error) {
+	realm, err := url.Parse(c.Params["realm"])
+	if err != nil || (realm.Scheme != "https" && realm.Scheme != "http") {
+		return "", fmt.Errorf("invalid token realm %q", c.Params["realm"])
+	}
+	if realm.Scheme == "http" && !a.Insecure {
+		return "", fmt.Errorf("refusing to fetch a token from the insecure realm %s", realm)
+	}
+	query := realm.Query()
+	for _, name := range []string{"service", "scope"} {
+		if v := c.Params[name]; v != "" {
+			query.Set(name, v)
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if a.Authorize != nil && (realm.Host == host || a.ForeignRealmAuth) {
+		a.Authorize(host, req)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad HTTP status code from %s: %d", realm.Host, res.StatusCode)
+	}
+	var tok dockerToken
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("invalid token response from %s: %v", realm.Host, err)
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	if tok.Token == "" {
+		return "", fmt.Errorf("no token in the response from %s", realm.Host)
+	}
+	return tok.Token, nil
+}
+
+// tokenCache holds the bearer tokens acquired for the hosts, shared by the
+// pushes of UploadMirror.
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// withTokenCache returns the Uploader with the token cache its pushes
+// share, creating it if it has none yet.
+func (u Uploader) withTokenCache() Uploader {
+	if u.tokens == nil && u.TokenAcquirer != nil {
+		u.tokens = &tokenCache{tokens: make(map[string]string)}
+	}
+	return u
+}
+
+// cachedToken returns the token acquired for host, if any.
+func (u Uploader) cachedToken(host string) string {
+	if u.tokens == nil {
+		return ""
+	}
+	u.tokens.mu.Lock()
+	defer u.tokens.mu.Unlock()
+	return u.tokens.tokens[host]
+}
+
+// bearerChallenge returns the Bearer challenge of the 401 response, if any,
+// for which a token can be acquired.
+func (u Uploader) bearerChallenge(res *http.Response) (Challenge, bool) {
+	if u.TokenAcquirer == nil || u.tokens == nil {
+		return Challenge{}, false
+	}
+	for _, c := range parseChallenges(res.Header["Www-Authenticate"]) {
+		if strings.EqualFold(c.Scheme, "bearer") && c.Params["realm"] != "" {
+			return c, true
+		}
+	}
+	return Challenge{}, false
+}
+
+// acquireToken acquires a token for host as asked for by the challenge, and
+// caches it for the next requests.
+func (u Uploader) acquireToken(host string, c Challenge) error {
+	if u.Debug {
+		stderr("acquiring a token for %s from %s", host, c.Params["realm"])
+	}
+	// The client has no token cache, for the token requests not to be
+	// authorized with a rejected token.
+	tu := u
+	tu.tokens = nil
+	token, err := u.TokenAcquirer.AcquireToken(tu.httpClient(), host, c)
+	if err != nil {
+		return fmt.Errorf("error acquiring a token for %s: %v", host, err)
+	}
+	u.tokens.mu.Lock()
+	u.tokens.tokens[host] = token
+	u.tokens.mu.Unlock()
+	return nil
+}
+
+// parseChallenges parses the challenges of WWW-Authenticate header values,
+// made of an authentication scheme followed by comma separated name=value
+// parameters, whose values may be quoted.
+func parseChallenges(values []string) []Challenge {
+	var challenges []Challenge
+	for _, v := range values {
+		var cur *Challenge
+		for v = skipSpaceComma(v); v != ""; v = skipSpaceComma(v) {
+			var tok string
+			tok, v = readToken(v)
+			if tok == "" {
+				// Malformed: the rest of the value is ignored.
+				break
+			}
+			rest := strings.TrimLeft(v, " \t")
+			if cur == nil || !strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, "==") {
+				// A token not followed by = starts a challenge;
+				// token68 credentials are skipped.
+				challenges = append(challenges, Challenge{Scheme: tok, Params: make(map[string]string)})
+				cur = &challenges[len(challenges)-1]
+				for strings.HasPrefix(strings.TrimLeft(v, " \t"), "=") {
+					v = strings.TrimLeft(v, " \t")[1:]
+				}
+				continue
+			}
+			v = strings.TrimLeft(rest[1:], " \t")
+			var value string
+			if strings.HasPrefix(v, `"`) {
+				value, v = readQuoted(v)
+			} else {
+				value, v = readToken(v)
+			}
+			cur.Params[strings.ToLower(tok)] = value
+		}
+	}
+	return challenges
+}
+
+func skipSpaceComma(s string) string {
+	return strings.TrimLeft(s, " \t,")
+}
+
+// readToken reads the token at the start of s, up to a separator.
+func readToken(s string) (string, string) {
+	i := strings.IndexAny(s, " \t,=\"")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// readQuoted reads the quoted string at the start of s, unescaping it.
+func readQuoted(s string) (string, string) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:]
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), ""
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestTokenRealmCredentials checks that the credentials of a registry are
+// only sent to a realm on another host when asked for, and that http realms
+// need Insecure.
+func TestTokenRealmCredentials(t *testing.T) {
+	var authorized bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorized = r.Header.Get("Authorization") != ""
+		fmt.Fprint(w, `{"token":"tok"}`)
+	}))
+	defer srv.Close()
+	c := Challenge{Scheme: "Bearer", Params: map[string]string{"realm": srv.URL + "/token"}}
+	authorize := func(host string, req *http.Request) { req.SetBasicAuth("user", "password") }
+
+	a := &DockerTokenAcquirer{Authorize: authorize}
+	if _, err := a.AcquireToken(srv.Client(), "registry.example.com", c); err == nil {
+		t.Error("a token was fetched from an http realm without Insecure")
+	}
+	for _, tt := range []struct {
+		foreign bool
+		want    bool
+	}{
+		{false, false},
+		{true, true},
+	} {
+		a := &DockerTokenAcquirer{Authorize: authorize, Insecure: true, ForeignRealmAuth: tt.foreign}
+		if _, err := a.AcquireToken(srv.Client(), "registry.example.com", c); err != nil {
+			t.Fatal(err)
+		}
+		if authorized != tt.want {
+			t.Errorf("ForeignRealmAuth %v: got credentials sent %v, want %v", tt.foreign, authorized, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// checkPartTransformer checks that the options of the push hold for parts
+// transformed by PartTransformer, whose bytes are only known as they are
+// sent.
+func (u Uploader) checkPartTransformer() error {
+	if u.PartTransformer == nil {
+		return nil
+	}
+	if u.VerifyStreamedDigest {
+		return fmt.Errorf("the digest of the ACI sent can't be verified with a part transformer")
+	}
+	if u.SendDigest && !u.DigestTrailer {
+		return fmt.Errorf("the digests of transformed parts can only be sent as trailers")
+	}
+	return nil
+}
+
+// transformPart returns the header and body of the part as set by
+// PartHeader and PartTransformer.
+func (u Uploader) transformPart(label string, header http.Header, body io.Reader) (http.Header, io.Reader, error) {
+	part := strings.ToLower(label)
+	if u.PartHeader != nil {
+		extra := u.PartHeader(part)
+		if len(extra) != 0 {
+			merged := make(http.Header)
+			for k, v := range header {
+				merged[k] = v
+			}
+			for k, v := range extra {
+				merged[k] = v
+			}
+			header = merged
+		}
+	}
+	if u.PartTransformer != nil {
+		r, err := u.PartTransformer(part, body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error transforming the %s part: %v", part, err)
+		}
+		body = r
+	}
+	return header, body, nil
+}
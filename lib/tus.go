@@ -0,0 +1,299 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// uploadProtocolTus is the upload protocol of the servers taking the
+	// parts with the tus resumable upload protocol, with the part URLs
+	// as its creation endpoints.
+	uploadProtocolTus = "tus"
+
+	tusVersion     = "1.0.0"
+	tusChunkSize   = 8 << 20
+	tusMaxResumes  = 5
+	tusResumeDelay = time.Second
+)
+
+// tusUpload uploads a part with the tus protocol: an upload is created at
+// url, and the part is sent to it in chunks. A chunk whose transfer fails is
+// resumed from the offset reported by the server, so that only the chunk
+// read last is kept in memory and streams can be sent too.
+func (u Uploader) tusUpload(url string, header http.Header, body io.Reader, draw bool, label string) error {
+	size := bodySize(body)
+	creation := make(http.Header)
+	for k, v := range header {
+		creation[k] = v
+	}
+	creation.Set("Tus-Resumable", tusVersion)
+	if size >= 0 {
+		creation.Set("Upload-Length", strconv.FormatInt(size, 10))
+	} else {
+		creation.Set("Upload-Defer-Length", "1")
+	}
+
+	if u.printOnly {
+		req, err := http.NewRequestWithContext(u.context(), "POST", url, nil)
+		if err != nil {
+			return err
+		}
+		if err := u.setHeaders(req, creation); err != nil {
+			return err
+		}
+		u.printRequest(req, label+", tus upload creation", 0)
+		stderr("    followed by PATCH requests of up to %d bytes to the upload created", tusChunkSize)
+		return nil
+	}
+
+	// The upload of a session resumed is continued from where the
+	// server got it, unless it expired.
+	var offset int64
+	location := u.sessionUpload(label)
+	if location != "" {
+		var err error
+		offset, err = u.tusOffset(location)
+		if serr, ok := err.(tusStatusError); ok && (serr == http.StatusNotFound || serr == http.StatusGone) {
+			if u.Debug {
+				stderr("tus upload of %s at %s is gone, creating another", label, location)
+			}
+			location = ""
+			offset = 0
+		} else if err != nil {
+			return fmt.Errorf("error getting the offset to resume %s from: %v", label, err)
+		} else if u.Debug {
+			stderr("resuming the tus upload of %s at %s from offset %d", label, location, offset)
+		}
+	}
+	if location == "" {
+		var err error
+		if location, err = u.tusCreate(url, creation); err != nil {
+			return err
+		}
+		if u.Debug {
+			stderr("tus upload of %s created at %s", label, location)
+		}
+		u.recordUpload(label, location)
+	}
+
+	src := body
+	if f, ok := body.(*os.File); ok && draw && u.Debug {
+		var err error
+		if src, err = u.genProgressBar(f, f, label); err != nil {
+			return err
+		}
+	}
+	if u.meter != nil {
+		src = io.TeeReader(src, u.meter)
+	}
+	// What the server got already is still read, for the meter to see
+	// the whole part.
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, src, offset); err != nil {
+			return fmt.Errorf("error skipping the %d bytes of %s uploaded already: %v", offset, label, err)
+		}
+	}
+
+	chunk := make([]byte, tusChunkSize)
+	for {
+		n, err := io.ReadFull(src, chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		// The length of streams is only known, and sent, along with
+		// their last chunk.
+		if n > 0 || (last && size < 0) {
+			if err := u.tusPatch(location, chunk[:n], offset, last && size < 0); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// tusCreate creates a tus upload at url and returns its URL.
+func (u Uploader) tusCreate(url string, header http.Header) (string, error) {
+	res, err := u.tusRequest("POST", url, header, nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusCreated:
+	case http.StatusPreconditionFailed:
+		return "", errPreconditionFailed
+	default:
+		return "", fmt.Errorf("bad HTTP status code creating the tus upload: %d", res.StatusCode)
+	}
+	location, err := res.Location()
+	if err != nil {
+		return "", fmt.Errorf("tus upload created without its location: %v", err)
+	}
+	return location.String(), nil
+}
+
+// tusPatch sends the chunk, starting at offset start of the upload,
+// resuming it from the offset reported by the server when its transfer
+// fails. final sets the length of the upload to the end of the chunk.
+func (u Uploader) tusPatch(location string, chunk []byte, start int64, final bool) error {
+	end := start + int64(len(chunk))
+	offset := start
+	for resumes := 0; ; {
+		got, err := u.tusSend(location, chunk[offset-start:], offset, end, final)
+		if err == nil && got == end {
+			return nil
+		}
+		if err == nil && got > offset && got < end {
+			// The server took part of the chunk only.
+			offset = got
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("server reported offset %d after receiving bytes %d to %d", got, offset, end)
+		}
+		if serr, ok := err.(tusStatusError); ok && !serr.retryable() {
+			return err
+		}
+		if resumes == tusMaxResumes || u.context().Err() != nil {
+			return err
+		}
+		resumes++
+		if u.Debug {
+			stderr("tus: error sending bytes %d to %d to %s, resuming: %v", offset, end, location, err)
+		}
+		if serr := u.sleep(tusResumeDelay); serr != nil {
+			return fmt.Errorf("%v, and not resuming: %v", err, serr)
+		}
+		resumed, oerr := u.tusOffset(location)
+		if oerr != nil {
+			return fmt.Errorf("%v, and error getting the offset to resume from: %v", err, oerr)
+		}
+		if resumed < start || resumed > end {
+			return fmt.Errorf("%v, and can't resume from offset %d, only bytes %d to %d are kept to send again", err, resumed, start, end)
+		}
+		offset = resumed
+	}
+}
+
+// tusSend sends data at offset of the upload with a PATCH request, and
+// returns the offset reported by the server once received.
+func (u Uploader) tusSend(location string, data []byte, offset, end int64, final bool) (int64, error) {
+	header := make(http.Header)
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Content-Type", "application/offset+octet-stream")
+	header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if final {
+		header.Set("Upload-Length", strconv.FormatInt(end, 10))
+	}
+	res, err := u.tusRequest("PATCH", location, header, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return 0, tusStatusError(res.StatusCode)
+	}
+	return parseUploadOffset(res)
+}
+
+// tusOffset returns the offset of the upload, up to which the server
+// received it.
+func (u Uploader) tusOffset(location string) (int64, error) {
+	header := make(http.Header)
+	header.Set("Tus-Resumable", tusVersion)
+	res, err := u.tusRequest("HEAD", location, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return 0, tusStatusError(res.StatusCode)
+	}
+	return parseUploadOffset(res)
+}
+
+func parseUploadOffset(res *http.Response) (int64, error) {
+	offset, err := strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Upload-Offset: %q", res.Header.Get("Upload-Offset"))
+	}
+	return offset, nil
+}
+
+// tusRequest performs a request of the tus protocol, whose responses are
+// returned whatever their status.
+func (u Uploader) tusRequest(method, url string, header http.Header, body io.Reader) (*http.Response, error) {
+	ctx := u.context()
+	if u.TraceTiming {
+		ctx = withTimingTrace(ctx, method)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	u.limitBody(req)
+	u.reportProgress(req)
+	if err := u.setHeaders(req, header); err != nil {
+		return nil, err
+	}
+	if u.Curl {
+		// The chunks sent aren't printed, only the headers.
+		if err := u.printCurl(req, nil); err != nil {
+			return nil, err
+		}
+	}
+	res, err := u.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized && u.retriesUnauthorized(res) {
+		res.Body.Close()
+		return u.retryUnauthorized(req, header, res)
+	}
+	return res, nil
+}
+
+// tusStatusError is the unexpected status of a response of the tus
+// protocol.
+type tusStatusError int
+
+func (e tusStatusError) Error() string {
+	return fmt.Sprintf("bad HTTP status code: %d", int(e))
+}
+
+// isTusRetryable reports whether err is a tusStatusError which is retryable.
+func isTusRetryable(err error) bool {
+	serr, ok := err.(tusStatusError)
+	return ok && serr.retryable()
+}
+
+// retryable reports whether the request may succeed once resumed from the
+// offset of the server: on server errors, and on conflicting offsets.
+func (e tusStatusError) retryable() bool {
+	return e >= 500 || e == http.StatusConflict || e == http.StatusLocked
+}
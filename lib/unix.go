@@ -0,0 +1,70 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// unixTransport sends the requests of unix:// URLs over the Unix socket at
+// the start of their path, with the rest of it as the HTTP path.
+type unixTransport struct{}
+
+func (unixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	socket, path, err := splitUnixPath(req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+		DisableKeepAlives: true,
+	}
+	sreq := req.Clone(req.Context())
+	sreq.URL.Scheme = "http"
+	sreq.URL.Host = "localhost"
+	sreq.URL.Path = path
+	sreq.URL.RawPath = ""
+	sreq.Host = "localhost"
+	res, err := t.RoundTrip(sreq)
+	if err != nil {
+		return nil, err
+	}
+	res.Request = req
+	return res, nil
+}
+
+// splitUnixPath splits the path of a unix:// URL into the path of the Unix
+// socket it starts with and the HTTP path following it.
+func splitUnixPath(path string) (string, string, error) {
+	for i := len(path); i > 0; i = strings.LastIndex(path[:i], "/") {
+		finfo, err := os.Stat(path[:i])
+		if err == nil && finfo.Mode()&os.ModeSocket != 0 {
+			rest := path[i:]
+			if rest == "" {
+				rest = "/"
+			}
+			return path[:i], rest, nil
+		}
+	}
+	return "", "", fmt.Errorf("no Unix socket found in %s", path)
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pushServer is a push server storing the digest of the ACIs uploaded, and
+// counting the successful completions. The ACIs are only accepted with the
+// bearer token it hands out from /token.
+type pushServer struct {
+	mu          sync.Mutex
+	acis        map[string][sha256.Size]byte
+	completions map[string]int
+	tokens      int
+}
+
+func (s *pushServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	switch {
+	case r.URL.Query().Get("ac-discovery") == "1":
+		fmt.Fprintf(w, `<html><head><meta name="ac-push-discovery" content="example.com/app http://%s/init?name={name}"></head></html>`, r.Host)
+	case r.URL.Path == "/token":
+		s.mu.Lock()
+		s.tokens++
+		s.mu.Unlock()
+		fmt.Fprint(w, `{"token":"tok"}`)
+	case r.URL.Path == "/aci" && r.Header.Get("Authorization") != "Bearer tok":
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.URL.Path == "/init":
+		base := "http://" + r.Host
+		fmt.Fprintf(w, `{"aci_push_version":"0.0.1","upload_manifest_url":"%[1]s/manifest?name=%[2]s","upload_signature_url":"%[1]s/signature?name=%[2]s","upload_aci_url":"%[1]s/aci?name=%[2]s","completed_url":"%[1]s/complete?name=%[2]s"}`, base, name)
+	case r.URL.Path == "/aci":
+		h := sha256.New()
+		if _, err := io.Copy(h, r.Body); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+		s.mu.Lock()
+		s.acis[name] = sum
+		s.mu.Unlock()
+	case r.URL.Path == "/manifest" || r.URL.Path == "/signature":
+		io.Copy(ioutil.Discard, r.Body)
+	case r.URL.Path == "/complete":
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), `"success":true`) {
+			s.mu.Lock()
+			s.completions[name]++
+			s.mu.Unlock()
+		}
+		fmt.Fprint(w, `{"success":true}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeTestACI writes an uncompressed ACI of the given name to dir, padded
+// with a file of size bytes, along with a signature.
+func writeTestACI(t *testing.T, dir, name string, size int) (aci, asc string) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	manifest := fmt.Sprintf(`{"acKind":"ImageManifest","acVersion":"0.7.1","name":%q,"labels":[{"name":"version","value":"1.0.0"},{"name":"os","value":"linux"},{"name":"arch","value":"amd64"}]}`, name)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"manifest", []byte(manifest)},
+		{"rootfs/data", bytes.Repeat([]byte("acpush"), size/6)},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	aci = filepath.Join(dir, "image.aci")
+	asc = filepath.Join(dir, "image.aci.asc")
+	if err := ioutil.WriteFile(aci, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(asc, []byte("signature"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return aci, asc
+}
+
+// TestConcurrentUploads pushes an image several times at once with a single
+// Uploader, as documented to be safe, with Upload and UploadMirror. The
+// server is reached as a proxy, so that meta discovery goes to it too. It is
+// meant to be run with -race.
+func TestConcurrentUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acpush-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aci, asc := writeTestACI(t, dir, "example.com/app", 1<<20)
+	blob, err := ioutil.ReadFile(aci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(blob)
+
+	s := &pushServer{acis: make(map[string][sha256.Size]byte), completions: make(map[string]int)}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	var log bytes.Buffer
+	u := Uploader{
+		Acipath:         aci,
+		Ascpath:         asc,
+		Uri:             "example.com/app:1.0.0",
+		Insecure:        true,
+		Proxy:           srv.URL,
+		Parallel:        2,
+		Headers:         http.Header{"X-Test": {"1"}},
+		SendDigest:      true,
+		RateLimit:       64 << 20,
+		MaxConnsPerHost: 2,
+		Log:             &log,
+		SetHTTPHeaders:  func(r *http.Request) { r.Header.Set("X-Set", "1") },
+		TokenAcquirer:   &DockerTokenAcquirer{Insecure: true},
+	}
+
+	const pushes = 8
+	var wg sync.WaitGroup
+	errs := make([]error, pushes)
+	for i := 0; i < pushes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				errs[i] = u.Upload()
+				return
+			}
+			for _, err := range u.UploadMirror([]string{u.Uri, u.Uri}) {
+				if err != nil {
+					errs[i] = err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("push %d: %v", i, err)
+		}
+	}
+	if s.acis["example.com/app"] != want {
+		t.Error("the ACI was not uploaded whole")
+	}
+	if got, want := s.completions["example.com/app"], pushes/2+pushes; got != want {
+		t.Errorf("got %d completions, want %d", got, want)
+	}
+	if s.tokens == 0 {
+		t.Error("no token was acquired")
+	}
+}
+
+// TestInterceptorsRunOnce checks that the Interceptors run once for every
+// request sent, when the requests are printed as curl commands too.
+func TestInterceptorsRunOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acpush-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aci, asc := writeTestACI(t, dir, "example.com/app", 1<<10)
+
+	s := &pushServer{acis: make(map[string][sha256.Size]byte), completions: make(map[string]int)}
+	var (
+		mu                 sync.Mutex
+		calls, intercepted int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Intercepted") != "" {
+			mu.Lock()
+			intercepted++
+			mu.Unlock()
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	u := Uploader{
+		Acipath:       aci,
+		Ascpath:       asc,
+		Uri:           "example.com/app:1.0.0",
+		Insecure:      true,
+		Proxy:         srv.URL,
+		Curl:          true,
+		TokenAcquirer: &DockerTokenAcquirer{Insecure: true},
+		Interceptors: []func(*http.Request) error{
+			func(r *http.Request) error {
+				mu.Lock()
+				calls++
+				mu.Unlock()
+				r.Header.Set("X-Intercepted", "1")
+				return nil
+			},
+		},
+	}
+	if err := u.Upload(); err != nil {
+		t.Fatal(err)
+	}
+	if intercepted == 0 {
+		t.Error("no request was intercepted")
+	}
+	if calls != intercepted {
+		t.Errorf("the interceptors ran %d times for %d requests", calls, intercepted)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/discovery"
+)
+
+const verifyInterval = 2 * time.Second
+
+// verifyPush checks that the pushed image can be found via the regular
+// (non-push) meta discovery, retrying until VerifyTimeout elapses.
+func (u Uploader) verifyPush(app *discovery.App) error {
+	// The ext label is rendered by discovery itself for the ACI and
+	// signature endpoints.
+	app = app.Copy()
+	delete(app.Labels, extLabelName)
+
+	// The requests are bounded by the deadline too, and cancelled along
+	// with the push.
+	deadline := time.Now().Add(u.VerifyTimeout)
+	ctx, cancel := context.WithDeadline(u.context(), deadline)
+	defer cancel()
+	for {
+		err := u.checkAvailable(ctx, app)
+		if err == nil {
+			if u.Debug {
+				stderr("image is available")
+			}
+			return nil
+		}
+		if u.context().Err() != nil {
+			return fmt.Errorf("image availability not verified: %v", u.context().Err())
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("image not available after push: %v", err)
+		}
+		if u.Debug {
+			stderr("image not available yet: %v", err)
+		}
+		select {
+		case <-time.After(verifyInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (u Uploader) checkAvailable(ctx context.Context, app *discovery.App) error {
+	eps, _, err := u.discoverEndpoints(app)
+	if err != nil {
+		return err
+	}
+	if len(eps.ACIEndpoints) == 0 {
+		return fmt.Errorf("no ACI endpoints discovered")
+	}
+
+	aciurl := eps.ACIEndpoints[0].ACI
+	if u.Debug {
+		stderr("verifying image at %s", aciurl)
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", aciurl, nil)
+	if err != nil {
+		return err
+	}
+	if err := u.setHeaders(req, nil); err != nil {
+		return err
+	}
+	res, err := u.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad HTTP status code: %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 appc authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/discovery"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema/types"
+)
+
+// warnings collects the warnings of a push, until the end of the phase
+// they were raised in.
+type warnings struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+// warnf raises a warning about the push. It is printed, or turned into an
+// error with FailOnWarning, by checkWarnings at the end of the phase. There
+// being no phase outside of a push, it is printed right away then.
+func (u Uploader) warnf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if u.warnings == nil {
+		stderr("warning: %s", msg)
+		return
+	}
+	u.warnings.mu.Lock()
+	defer u.warnings.mu.Unlock()
+	u.warnings.msgs = append(u.warnings.msgs, msg)
+}
+
+// checkWarnings ends a phase of the push: the warnings raised during it are
+// printed, or returned as an error with FailOnWarning.
+func (u Uploader) checkWarnings() error {
+	if u.warnings == nil {
+		return nil
+	}
+	u.warnings.mu.Lock()
+	msgs := u.warnings.msgs
+	u.warnings.msgs = nil
+	u.warnings.mu.Unlock()
+	if len(msgs) == 0 {
+		return nil
+	}
+	if u.FailOnWarning {
+		return fmt.Errorf("warnings treated as errors: %s", strings.Join(msgs, "; "))
+	}
+	for _, msg := range msgs {
+		stderr("warning: %s", msg)
+	}
+	return nil
+}
+
+// printWarnings prints the warnings raised since the end of the last phase
+// of the push, once it is over.
+func (u Uploader) printWarnings() {
+	u.warnings.mu.Lock()
+	defer u.warnings.mu.Unlock()
+	for _, msg := range u.warnings.msgs {
+		stderr("warning: %s", msg)
+	}
+	u.warnings.msgs = nil
+}
+
+// checkLabels warns about the labels of the app whose value differs from
+// the one of the manifest.
+func (u Uploader) checkLabels(app *discovery.App, manifest *schema.ImageManifest) {
+	var names []string
+	for name := range app.Labels {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		got := app.Labels[types.ACIdentifier(name)]
+		if want, ok := manifest.Labels.Get(name); ok && got != want {
+			u.warnf("label %s is %q, but %q in the manifest", name, got, want)
+		}
+	}
+}
+
+// armoredSignature is the start of an ASCII armored OpenPGP signature.
+var armoredSignature = []byte("-----BEGIN PGP SIGNATURE-----")
+
+// checkSignature warns if the signature file doesn't look like an OpenPGP
+// signature, either ASCII armored or binary.
+func (u Uploader) checkSignature(sig io.Reader) error {
+	f, ok := sig.(*os.File)
+	if !ok {
+		return nil
+	}
+	head := make([]byte, 64)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	head = head[:n]
+	if bytes.HasPrefix(bytes.TrimSpace(head), armoredSignature) || isSignaturePacket(head) {
+		return nil
+	}
+	u.warnf("%s doesn't look like an OpenPGP signature", f.Name())
+	return nil
+}
+
+// isSignaturePacket returns whether b starts with the header of an OpenPGP
+// signature packet, of either the old or the new format.
+func isSignaturePacket(b []byte) bool {
+	if len(b) == 0 || b[0]&0x80 == 0 {
+		return false
+	}
+	const signatureTag = 2
+	if b[0]&0x40 != 0 {
+		return b[0]&0x3f == signatureTag
+	}
+	return (b[0]>>2)&0x0f == signatureTag
+}
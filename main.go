@@ -15,13 +15,19 @@
 package main
 
 import (
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/appc/acpush/Godeps/_workspace/src/github.com/coreos/rkt/rkt/config"
 	"github.com/appc/acpush/Godeps/_workspace/src/github.com/spf13/cobra"
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/spf13/pflag"
 
 	"github.com/appc/acpush/lib"
 )
@@ -29,13 +35,102 @@ import (
 var (
 	flagDebug           bool
 	flagInsecure        bool
+	flagFormat          string
+	flagRepository      string
+	flagDumpManifest    bool
+	flagEndpoint        string
+	flagCompress        string
+	flagStreaming       bool
+	flagTempDir         string
+	flagDefaultArch     string
+	flagExt             string
+	flagDefaultOS       string
+	flagNoAutoLabel     bool
+	flagRequireLabels   []string
+	flagForbidLatest    bool
+	flagRequiredAnnots  []string
+	flagNoRedirectBar   bool
+	flagTraceDiscovery  bool
+	flagPrintRequests   bool
+	flagPayloadSchema   string
+	flagCurl            bool
+	flagTraceTiming     bool
 	flagUser            string
 	flagPassword        string
 	flagSystemConfigDir string
 	flagLocalConfigDir  string
+	flagLenientConfig   bool
+	flagStrict          bool
+	flagNetrc           string
+	flagAnnotations     = keyValueFlag{}
+	flagCompleteFields  = keyValueFlag{}
+	flagLabelAnnots     = keyValueFlag{}
+	flagVerifyAfterPush bool
+	flagVerifyTimeout   time.Duration
+	flagConfigFile      string
+	flagPollTimeout     time.Duration
+	flagFailFast        bool
+	flagSendDigest      bool
+	flagDigestTrailer   bool
+	flagContentAddr     bool
+	flagShowDiscovery   bool
+	flagJitter          string
+	flagFromDir         string
+	flagInsecureRedir   bool
+	flagTLSMinVersion   tlsVersionFlag
+	flagTLSMaxVersion   tlsVersionFlag
+	flagCertPins        []string
+	flagResolver        string
+	flagProxy           string
+	flagProxyAuth       string
+	flagSOCKS5          string
+	flagQuietSuccess    bool
+	flagCompressLevel   int
+	flagContentEncoding string
+	flagRewrites        = keyValueFlag{}
+	flagParallel        int
+	flagIdempotencyKey  string
+	flagHeadersFile     string
+	flagCredHelper      string
+	flagSignKey         string
+	flagSignPassphrase  string
+	flagSignPassFile    string
+	flagVerifyStreamed  bool
+	flagNoOverwrite     bool
+	flagIfMatch         bool
+	flagTimeout         time.Duration
+	flagDiscoveryTTL    time.Duration
+	flagNoDiscCache     bool
+	flagSinceModified   bool
+	flagStateFile       string
+	flagForce           bool
+	flagConfirm         bool
+	flagYes             bool
+	flagAlwaysAuth      bool
+	flagRealmAuth       bool
+	flagResumeComplete  bool
+	flagInitiationBody  bool
+	flagInlineManifest  bool
+	flagSendSize        bool
+	flagLogFile         string
+	flagMinACVersion    string
+	flagMaxACVersion    string
+	flagCompletionState string
+	flagResume          bool
+	flagSessionFile     string
+	flagCompleteRetries int
+	flagPartTimeout     time.Duration
+	flagReadBufferSize  int
+	flagMmap            bool
+	flagRateLimit       rateLimitFlag
+	flagMaxConns        int
+	flagProgressFd      int
+	flagProgressFormat  string
+	flagDigestParts     []string
+	flagKeepGoing       bool
 
 	cmdACPush = &cobra.Command{
-		Use:   "acpush [OPTIONS] IMAGE SIGNATURE URL",
+		Use:   "acpush [OPTIONS] IMAGE SIGNATURE [URL...]",
 		Short: "A utility for pushing ACI files to remote servers",
 		Run:   runACPush,
 	}
@@ -43,64 +138,770 @@ var (
 
 func init() {
 	cmdACPush.Flags().BoolVar(&flagDebug, "debug", false, "Enables debug messages")
+	cmdACPush.Flags().BoolVar(&flagQuietSuccess, "quiet-success", false, "Prints nothing once the push succeeded, only errors and progress")
 	cmdACPush.Flags().BoolVar(&flagInsecure, "insecure", false, "Permits unencrypted traffic")
+	cmdACPush.Flags().StringVar(&flagProxy, "proxy", "", "URL of the proxy to send the requests through, instead of the one of the HTTP_PROXY and HTTPS_PROXY environment variables")
+	cmdACPush.Flags().StringVar(&flagProxyAuth, "proxy-auth", "", "Credentials to authenticate to the proxy with, as user:password")
+	cmdACPush.Flags().StringVar(&flagSOCKS5, "socks5", "", "Sends the requests through the SOCKS5 proxy at the given [user:password@]host:port")
+	cmdACPush.Flags().StringVar(&flagResolver, "resolver", "", "Resolves host names with the DNS server at the given host:port instead of the system resolver")
+	cmdACPush.Flags().Var(&flagTLSMinVersion, "tls-min-version", "Minimum TLS version to negotiate: 1.0, 1.1, 1.2 or 1.3")
+	cmdACPush.Flags().Var(&flagTLSMaxVersion, "tls-max-version", "Maximum TLS version to negotiate: 1.0, 1.1, 1.2 or 1.3")
+	cmdACPush.Flags().StringSliceVar(&flagCertPins, "pin-cert-sha256", nil, "Hex SHA-256 digest of the public key or certificate the servers must present, may be given multiple times for rotation")
+	cmdACPush.Flags().StringVar(&flagFormat, "format", lib.FormatACI, "Format of the image to push, aci or oci")
+	cmdACPush.Flags().StringVar(&flagFromDir, "from-dir", "", "Builds the ACI from the unpacked ACI layout at the given path while pushing it, in place of the IMAGE argument")
+	cmdACPush.Flags().StringVar(&flagEndpoint, "endpoint", "", "Push endpoint to use instead of meta discovery, as a template such as the ones of ac-push-discovery meta tags, or a unix:// URL to push over a Unix socket")
+	cmdACPush.Flags().StringVar(&flagRepository, "repository", "", "Image name to push to instead of the one in the URL, keeping its labels")
+	cmdACPush.Flags().StringVar(&flagExt, "ext", "", "Ext label to push the image with if not in the URL, such as aci.gz, instead of the one derived from the image format")
+	cmdACPush.Flags().StringVar(&flagDefaultArch, "default-arch", "", "Arch label to use if specified neither in the URL nor in the manifest")
+	cmdACPush.Flags().StringVar(&flagDefaultOS, "default-os", "", "OS label to use if specified neither in the URL nor in the manifest")
+	cmdACPush.Flags().BoolVar(&flagNoAutoLabel, "no-auto-label", false, "Uses the labels in the URL as they are instead of adding the arch, os and ext labels from the image")
+	cmdACPush.Flags().BoolVar(&flagStreaming, "streaming", false, "Reads the ACI as a stream, such as a pipe or - for stdin, instead of seeking in it")
+	cmdACPush.Flags().StringVar(&flagTempDir, "temp-dir", "", "Directory to stage the ACI to when read from stdin without --streaming or fetched from a URL, instead of the default temp dir")
+	cmdACPush.Flags().BoolVar(&flagForbidLatest, "forbid-latest", false, "Refuses to push images whose manifest has no version label or the latest one")
+	cmdACPush.Flags().StringSliceVar(&flagRequiredAnnots, "require-annotation", nil, "Annotation the manifest must have for the image to be pushed, may be given multiple times")
+	cmdACPush.Flags().Var(flagLabelAnnots, "label-from-annotation", "Annotation to read a label from when the manifest lacks it, as label=annotation, such as arch=build.arch; may be given multiple times")
+	cmdACPush.Flags().StringSliceVar(&flagRequireLabels, "require-label", nil, "Additional label needed for discovery, taken from the manifest if missing from the URL, may be given multiple times")
+	cmdACPush.Flags().StringVar(&flagMinACVersion, "min-ac-version", "", "Oldest acVersion of the manifest to accept")
+	cmdACPush.Flags().StringVar(&flagMaxACVersion, "max-ac-version", "", "Newest acVersion of the manifest to accept, defaults to the spec version acpush is built against")
+	cmdACPush.Flags().StringVar(&flagCompress, "compress", "", "Compresses uncompressed images while uploading them, only gzip is supported")
+	cmdACPush.Flags().IntVar(&flagCompressLevel, "compress-level", 6, "Compression level of --compress and --content-encoding, from 1 (fastest) to 9 (smallest)")
+	cmdACPush.Flags().StringVar(&flagContentEncoding, "content-encoding", "", "Compresses the ACI on the wire only, with an HTTP Content-Encoding the server decodes, unlike --compress; only gzip is supported")
+	cmdACPush.Flags().BoolVar(&flagNoRedirectBar, "no-progress-when-redirected", false, "Disables the progress bar when an upload is restarted after a redirect")
+	cmdACPush.Flags().BoolVar(&flagTraceDiscovery, "trace-discovery", false, "Logs every meta discovery attempt")
+	cmdACPush.Flags().BoolVar(&flagDumpManifest, "dump-manifest", false, "Prints the manifest of the image as it was read, before deriving labels from it")
+	cmdACPush.Flags().BoolVar(&flagPrintRequests, "print-requests", false, "Prints the requests following the upload initiation instead of sending them")
+	cmdACPush.Flags().StringVar(&flagPayloadSchema, "validate-schema", "", "Checks the initiation and completion payloads against the JSON schemas of the given file before sending them")
+	cmdACPush.Flags().BoolVar(&flagCurl, "curl", false, "Prints an equivalent curl command for every request sent")
+	cmdACPush.Flags().BoolVar(&flagTraceTiming, "trace-timing", false, "Logs the DNS, connect, TLS and time to first byte durations of every request")
+	cmdACPush.Flags().BoolVar(&flagInitiationBody, "initiation-body", false, "Describes the image in the body of the initiation request, for servers supporting it")
+	cmdACPush.Flags().BoolVar(&flagSendSize, "send-size", false, "Sends the size of the ACI in an X-ACI-Size header of the initiation request, for servers to refuse images over their quota before any transfer")
+	cmdACPush.Flags().BoolVar(&flagInlineManifest, "inline-manifest", false, "Sends the manifest in the body of the initiation request, skipping the manifest part for servers taking it from there")
+	cmdACPush.Flags().Var(flagRewrites, "rewrite", "Rewrites image names starting with from to start with to instead, as from=to, may be given multiple times")
+	cmdACPush.Flags().Var(flagAnnotations, "annotation", "Annotation to send along with the push, may be given multiple times")
+	cmdACPush.Flags().Var(flagCompleteFields, "completion-field", "Field to add to the completion of the push, as name=value, for servers understanding it; may be given multiple times")
+	cmdACPush.Flags().BoolVar(&flagVerifyAfterPush, "verify-after-push", false, "Checks that the image can be discovered and fetched after the push")
+	cmdACPush.Flags().DurationVar(&flagVerifyTimeout, "verify-timeout", 30*time.Second, "How long to wait for the image to be available with --verify-after-push")
+	cmdACPush.Flags().DurationVar(&flagPollTimeout, "completion-poll-timeout", 10*time.Minute, "How long to wait for the server to process the image after the upload, 0 for no limit")
+	cmdACPush.Flags().StringVar(&flagJitter, "retry-jitter", lib.JitterFull, "Randomizes the backoff between completion retries: none, full or equal")
+	cmdACPush.Flags().BoolVar(&flagShowDiscovery, "show-discovery", false, "Prints the push endpoints found by meta discovery, as templates and expanded, and exits")
+	cmdACPush.Flags().BoolVar(&flagContentAddr, "content-addressable", false, "Pushes the image to the {digest} placeholder of the push endpoint, replaced by its image ID")
+	cmdACPush.Flags().BoolVar(&flagSendDigest, "send-digest", false, "Sends a Digest header with the SHA-256 digest of the uploaded parts")
+	cmdACPush.Flags().BoolVar(&flagVerifyStreamed, "verify-streamed-digest", false, "Fails the push instead of completing it if the ACI changed while uploading it")
+	cmdACPush.Flags().BoolVar(&flagDigestTrailer, "digest-trailer", false, "Sends the digests of --send-digest in trailers, computed while uploading, for servers reading them")
+	cmdACPush.Flags().StringSliceVar(&flagDigestParts, "digest-parts", nil, "Parts to send a digest for with --send-digest, among manifest, signature and aci, defaults to all")
+	cmdACPush.Flags().BoolVar(&flagNoOverwrite, "no-overwrite", false, "Asks the server to reject the push if the image version already exists")
+	cmdACPush.Flags().BoolVar(&flagIfMatch, "if-match", false, "Asks the server to reject the push if the image was pushed by someone else since the ETag recorded in the state file")
+	cmdACPush.Flags().StringVar(&flagIdempotencyKey, "idempotency-key", "", "Key sent in the Idempotency-Key header of the push, a random one if not given")
+	cmdACPush.Flags().DurationVar(&flagDiscoveryTTL, "discovery-cache-ttl", 0, "Time for which the push endpoints discovered for an image name are cached in ~/.acpush/discovery.json, 0 disabling the cache")
+	cmdACPush.Flags().BoolVar(&flagNoDiscCache, "no-discovery-cache", false, "Performs meta discovery without reading or saving the discovery cache")
+	cmdACPush.Flags().DurationVar(&flagTimeout, "timeout", 0, "Time limit for the requests of the push altogether, 0 for no limit")
+	cmdACPush.Flags().DurationVar(&flagPartTimeout, "part-timeout", 0, "Time limit for the upload of each part, the stricter of it and --timeout applies, 0 for no limit")
+	cmdACPush.Flags().IntVar(&flagReadBufferSize, "read-buffer-size", 32<<10, "Size in bytes of the buffer the files are read with while uploading them, larger ones such as 1MiB may help on high latency links")
+	cmdACPush.Flags().Var(&flagRateLimit, "rate-limit", "Most bytes per second to upload at, such as 5MB or 512KiB, to a given host if given as host=rate, shared by the pushes of --parallel; may be given multiple times")
+	cmdACPush.Flags().IntVar(&flagProgressFd, "progress-fd", -1, "File descriptor to write the progress of the ACI upload to, as lines of the percentage sent, for progress UIs wrapping acpush")
+	cmdACPush.Flags().StringVar(&flagProgressFormat, "progress-format", "percent", "Format of the lines of --progress-fd: percent, or bytes for bytes/total lines, with a total of -1 if unknown")
+	cmdACPush.Flags().IntVar(&flagMaxConns, "max-conns-per-host", 0, "Most requests in flight at once to a host, across the pushes of --parallel; the others wait for one to finish")
+	cmdACPush.Flags().BoolVar(&flagMmap, "mmap", false, "Maps the files in memory to upload them instead of reading them, which may be faster for huge images")
+	cmdACPush.Flags().BoolVar(&flagSinceModified, "since-modified", false, "Skips pushing the image to the URLs it was last pushed to unchanged")
+	cmdACPush.Flags().StringVar(&flagStateFile, "state-file", "", "File recording the pushed images for --since-modified and --if-match, defaults to ~/.acpush/state.json")
+	cmdACPush.Flags().BoolVar(&flagForce, "force", false, "Pushes the image with --since-modified even if it is unchanged")
+	cmdACPush.Flags().BoolVar(&flagConfirm, "confirm", false, "Describes the push and asks for confirmation before initiating it")
+	cmdACPush.Flags().BoolVar(&flagYes, "yes", false, "Confirms the push without asking with --confirm, as needed when not on a terminal")
+	cmdACPush.Flags().BoolVar(&flagResumeComplete, "resume-completion", false, "Retries the saved completion of a push whose parts were all uploaded, instead of pushing again")
+	cmdACPush.Flags().IntVar(&flagCompleteRetries, "completion-retries", 3, "Times the completion request is sent again when it fails transiently, with a growing delay, without uploading the parts again")
+	cmdACPush.Flags().StringVar(&flagCompletionState, "completion-state-file", "", "File where failed completions are saved, defaults to ~/.acpush/completions.json")
+	cmdACPush.Flags().BoolVar(&flagResume, "resume", false, "Continues the saved session of an interrupted push, skipping the parts uploaded and resuming the tus uploads from where the server got them")
+	cmdACPush.Flags().StringVar(&flagSessionFile, "session-file", "", "File where the sessions of the pushes going on are saved, for --resume to continue them; ~/.acpush/sessions.json with --resume")
+	cmdACPush.Flags().BoolVar(&flagFailFast, "fail-fast", false, "Stops pushing to the remaining URLs after a push fails, the default")
+	cmdACPush.Flags().BoolVar(&flagKeepGoing, "keep-going", false, "Pushes to every URL even after a push fails")
+	cmdACPush.Flags().IntVar(&flagParallel, "parallel", 1, "Number of URLs to push to at once")
+	cmdACPush.Flags().BoolVar(&flagAlwaysAuth, "always-auth", false, "Sends credentials to the part URLs even when they are on another host than the initiation endpoint")
+	cmdACPush.Flags().BoolVar(&flagRealmAuth, "realm-auth", false, "Sends the credentials of a registry to its token realm even when it is on another host")
+	cmdACPush.Flags().BoolVar(&flagInsecureRedir, "allow-insecure-redirect", false, "Follows redirects from https to http, which may send credentials in plaintext")
+	cmdACPush.Flags().StringVar(&flagLogFile, "log-file", "", "File to append a line to for every uploaded part and for the result of every push")
 	cmdACPush.Flags().StringVar(&flagUser, "username", "", "HTTP Username")
 	cmdACPush.Flags().StringVar(&flagPassword, "password", "", "HTTP Password")
+	cmdACPush.Flags().StringVar(&flagNetrc, "netrc", "", "netrc file to read credentials from, defaults to ~/.netrc if it exists")
 	cmdACPush.Flags().StringVar(&flagSystemConfigDir, "system-conf", "/usr/lib/rkt", "Directory for system configuration")
 	cmdACPush.Flags().StringVar(&flagLocalConfigDir, "local-conf", "/etc/rkt", "Directory for local configuration")
+	cmdACPush.Flags().StringVar(&flagConfigFile, "config-file", "", "JSON file with default values for acpush's flags")
+	cmdACPush.Flags().StringVar(&flagSignKey, "sign-key", "", "File of the OpenPGP private key to sign the ACI with, in which case the SIGNATURE argument is left out")
+	cmdACPush.Flags().StringVar(&flagSignPassphrase, "sign-passphrase", "", "Passphrase of the key of --sign-key")
+	cmdACPush.Flags().StringVar(&flagSignPassFile, "sign-passphrase-file", "", "File holding the passphrase of the key of --sign-key")
+	cmdACPush.Flags().StringVar(&flagCredHelper, "credential-helper", "", "Program printing the credentials of each host, run with the get argument and the host on stdin as docker credential helpers are; the config and netrc credentials are used for hosts it has none for")
+	cmdACPush.Flags().StringVar(&flagHeadersFile, "headers-file", "", "File of headers to set on every request, as Name: value lines or a JSON object, taking precedence over the other headers")
+	cmdACPush.Flags().BoolVar(&flagLenientConfig, "lenient-config", false, "Skip configuration files that fail to parse instead of aborting")
+	cmdACPush.Flags().BoolVar(&flagStrict, "strict", false, "Fails the push on warnings, such as an image not compressed as requested or labels differing from the manifest's, instead of printing them")
+	cmdACPush.Flags().BoolVar(&flagStrict, "fail-on-warning", false, "Same as --strict")
 }
 
 func main() {
+	// cobra takes the arguments of a command with subcommands for the
+	// name of one of them, so they are dropped when pushing to let the
+	// image and signature through.
+	if _, _, err := cmdACPush.Find(os.Args[1:]); err != nil {
+		cmdACPush.RemoveCommand(cmdCapabilities)
+	}
 	cmdACPush.Execute()
 }
 
+// settingsFile holds the settings that can be read from the file given
+// with --config-file. Flags given on the command line override them.
+type settingsFile struct {
+	Debug           *bool             `json:"debug"`
+	Insecure        *bool             `json:"insecure"`
+	CredHelper      *string           `json:"credentialHelper"`
+	Format          *string           `json:"format"`
+	Compress        *string           `json:"compress"`
+	ContentEncoding *string           `json:"contentEncoding"`
+	DefaultArch     *string           `json:"defaultArch"`
+	DefaultOS       *string           `json:"defaultOS"`
+	TraceDiscovery  *bool             `json:"traceDiscovery"`
+	VerifyAfterPush *bool             `json:"verifyAfterPush"`
+	VerifyTimeout   *string           `json:"verifyTimeout"`
+	PollTimeout     *string           `json:"completionPollTimeout"`
+	KeepGoing       *bool             `json:"keepGoing"`
+	SendDigest      *bool             `json:"sendDigest"`
+	DigestTrailer   *bool             `json:"digestTrailer"`
+	NoOverwrite     *bool             `json:"noOverwrite"`
+	Strict          *bool             `json:"strict"`
+	IfMatch         *bool             `json:"ifMatch"`
+	InitiationBody  *bool             `json:"initiationBody"`
+	InlineManifest  *bool             `json:"inlineManifest"`
+	SendSize        *bool             `json:"sendSize"`
+	Timeout         *string           `json:"timeout"`
+	DiscoveryTTL    *string           `json:"discoveryCacheTTL"`
+	NoDiscCache     *bool             `json:"noDiscoveryCache"`
+	PartTimeout     *string           `json:"partTimeout"`
+	RetryJitter     *string           `json:"retryJitter"`
+	TLSMinVersion   *string           `json:"tlsMinVersion"`
+	Resolver        *string           `json:"resolver"`
+	TempDir         *string           `json:"tempDir"`
+	Proxy           *string           `json:"proxy"`
+	SOCKS5          *string           `json:"socks5"`
+	TLSMaxVersion   *string           `json:"tlsMaxVersion"`
+	Annotations     map[string]string `json:"annotations"`
+	CompleteFields  map[string]string `json:"completionFields"`
+	LabelAnnots     map[string]string `json:"labelAnnotations"`
+	Headers         map[string]string `json:"headers"`
+}
+
+// loadSettingsFile reads the settings file at path and applies its values
+// to the flags not given on the command line. It returns the headers to set
+// on every request.
+func loadSettingsFile(flags *pflag.FlagSet, path string) (http.Header, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings settingsFile
+	if err := json.Unmarshal(blob, &settings); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	for _, s := range []struct {
+		flag  string
+		value interface{}
+	}{
+		{"debug", settings.Debug},
+		{"insecure", settings.Insecure},
+		{"credential-helper", settings.CredHelper},
+		{"format", settings.Format},
+		{"compress", settings.Compress},
+		{"content-encoding", settings.ContentEncoding},
+		{"default-arch", settings.DefaultArch},
+		{"default-os", settings.DefaultOS},
+		{"trace-discovery", settings.TraceDiscovery},
+		{"verify-after-push", settings.VerifyAfterPush},
+		{"verify-timeout", settings.VerifyTimeout},
+		{"completion-poll-timeout", settings.PollTimeout},
+		{"keep-going", settings.KeepGoing},
+		{"send-digest", settings.SendDigest},
+		{"digest-trailer", settings.DigestTrailer},
+		{"no-overwrite", settings.NoOverwrite},
+		{"strict", settings.Strict},
+		{"if-match", settings.IfMatch},
+		{"initiation-body", settings.InitiationBody},
+		{"inline-manifest", settings.InlineManifest},
+		{"send-size", settings.SendSize},
+		{"timeout", settings.Timeout},
+		{"discovery-cache-ttl", settings.DiscoveryTTL},
+		{"no-discovery-cache", settings.NoDiscCache},
+		{"part-timeout", settings.PartTimeout},
+		{"retry-jitter", settings.RetryJitter},
+		{"tls-min-version", settings.TLSMinVersion},
+		{"resolver", settings.Resolver},
+		{"temp-dir", settings.TempDir},
+		{"proxy", settings.Proxy},
+		{"socks5", settings.SOCKS5},
+		{"tls-max-version", settings.TLSMaxVersion},
+	} {
+		if err := setFlagDefault(flags, s.flag, s.value); err != nil {
+			return nil, fmt.Errorf("error in %s: %v", path, err)
+		}
+	}
+	for k, v := range settings.Annotations {
+		if _, ok := flagAnnotations[k]; !ok {
+			flagAnnotations[k] = v
+		}
+	}
+	for k, v := range settings.CompleteFields {
+		if _, ok := flagCompleteFields[k]; !ok {
+			flagCompleteFields[k] = v
+		}
+	}
+	for k, v := range settings.LabelAnnots {
+		if _, ok := flagLabelAnnots[k]; !ok {
+			flagLabelAnnots[k] = v
+		}
+	}
+
+	header := make(http.Header)
+	for k, v := range settings.Headers {
+		header.Set(k, v)
+	}
+	return header, nil
+}
+
+// setFlagDefault sets the flag to value, which is a pointer to the value's
+// type, unless the flag was given on the command line or value is nil.
+func setFlagDefault(flags *pflag.FlagSet, name string, value interface{}) error {
+	if flags.Changed(name) {
+		return nil
+	}
+	var str string
+	switch v := value.(type) {
+	case *bool:
+		if v == nil {
+			return nil
+		}
+		str = strconv.FormatBool(*v)
+	case *string:
+		if v == nil {
+			return nil
+		}
+		str = *v
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", value))
+	}
+	if err := flags.Set(name, str); err != nil {
+		return fmt.Errorf("invalid value for %s: %v", name, err)
+	}
+	return nil
+}
+
+func loadConfig() (*config.Config, error) {
+	if !flagLenientConfig {
+		return config.GetConfigFrom(flagSystemConfigDir, flagLocalConfigDir)
+	}
+	conf, errs, err := config.GetConfigFromLenient(flagSystemConfigDir, flagLocalConfigDir)
+	if err != nil {
+		return nil, err
+	}
+	if flagStrict && len(errs) != 0 {
+		var msgs []string
+		for _, e := range errs {
+			msgs = append(msgs, e.Error())
+		}
+		return nil, fmt.Errorf("warnings treated as errors: %s", strings.Join(msgs, "; "))
+	}
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "warning: skipping config file: %v\n", e)
+	}
+	return conf, nil
+}
+
+// hostAuth returns the credentials to use for the host, looking them up in
+// the config first and in the netrc file, if any, second. It returns nil if
+// there are none.
+func hostAuth(conf *config.Config, nrc *netrc, host string) config.Headerer {
+	if headerer, ok := conf.AuthPerHost[host]; ok {
+		return headerer
+	}
+	if creds, ok := conf.DockerCredentialsPerRegistry[host]; ok {
+		if flagDebug {
+			fmt.Fprintf(os.Stderr, "Using docker credentials from config for domain %s.\n", host)
+		}
+		return creds
+	}
+	if nrc != nil {
+		if creds, ok := nrc.credentials(host); ok {
+			if flagDebug {
+				fmt.Fprintf(os.Stderr, "Using credentials from netrc for domain %s.\n", host)
+			}
+			return creds
+		}
+	}
+	if flagDebug {
+		fmt.Fprintf(os.Stderr, "No auth present in config for domain %s.\n", host)
+	}
+	return nil
+}
+
 func runACPush(cmd *cobra.Command, args []string) {
-	if len(args) != 3 {
+	if flagFromDir != "" {
+		if cmd.Flags().Changed("format") {
+			fmt.Fprintln(os.Stderr, "--from-dir and --format are mutually exclusive")
+			os.Exit(1)
+		}
+		args = append([]string{flagFromDir}, args...)
+	}
+	if flagSignKey != "" && len(args) != 0 {
+		// The signature is made rather than given.
+		args = append([]string{args[0], ""}, args[1:]...)
+	}
+	if len(args) < 2 {
 		cmd.Usage()
 		os.Exit(1)
 	}
+	if flagSignPassphrase != "" && flagSignPassFile != "" {
+		fmt.Fprintln(os.Stderr, "--sign-passphrase and --sign-passphrase-file are mutually exclusive")
+		os.Exit(1)
+	}
+
+	if flagFailFast && flagKeepGoing {
+		fmt.Fprintln(os.Stderr, "--fail-fast and --keep-going are mutually exclusive")
+		os.Exit(1)
+	}
+
+	var header http.Header
+	if flagConfigFile != "" {
+		var err error
+		header, err = loadSettingsFile(cmd.Flags(), flagConfigFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading config file: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if flagTLSMinVersion != 0 && flagTLSMaxVersion != 0 && flagTLSMinVersion > flagTLSMaxVersion {
+		fmt.Fprintln(os.Stderr, "--tls-min-version is above --tls-max-version")
+		os.Exit(1)
+	}
+
+	if flagFromDir != "" {
+		flagFormat = lib.FormatACIDir
+		if flagCompress == "" {
+			flagCompress = lib.CompressionGzip
+		}
+	}
+
+	var fileHeader http.Header
+	if flagHeadersFile != "" {
+		var err error
+		fileHeader, err = loadHeadersFile(flagHeadersFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading headers file: %v\n", err)
+			os.Exit(2)
+		}
+	}
 
-	conf, err := config.GetConfigFrom(flagSystemConfigDir, flagLocalConfigDir)
+	conf, err := loadConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
 		os.Exit(2)
 	}
 
-	err = lib.Uploader{
-		Acipath:  args[0],
-		Ascpath:  args[1],
-		Uri:      args[2],
-		Insecure: flagInsecure,
-		Debug:    flagDebug,
+	var nrc *netrc
+	netrcPath := flagNetrc
+	if netrcPath == "" {
+		netrcPath = defaultNetrcPath()
+	}
+	if netrcPath != "" {
+		nrc, err = loadNetrc(netrcPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading netrc: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	defaults := make(map[string]lib.PushDefaults)
+	for prefix, d := range conf.PushDefaultsPerPrefix {
+		defaults[prefix] = lib.PushDefaults{
+			Endpoint: d.Endpoint,
+			Labels:   d.Labels,
+		}
+	}
+
+	// authorize adds the credentials of host to the request, which is to
+	// the host or to the realm of its token.
+	authorize := func(host string, r *http.Request) {
+		var headerer config.Headerer
+		if flagUser != "" && flagPassword != "" {
+			headerer = config.BasicCredentials{User: flagUser, Password: flagPassword}
+		} else if headerer = hostAuth(conf, nrc, host); headerer == nil {
+			return
+		}
+		for k, v := range headerer.Header() {
+			r.Header[k] = append(r.Header[k], v...)
+		}
+	}
+
+	uploader := lib.Uploader{
+		Acipath:   args[0],
+		Ascpath:   args[1],
+		Insecure:  flagInsecure,
+		Debug:     flagDebug,
+		Format:    flagFormat,
+		Compress:  flagCompress,
+		Streaming: flagStreaming,
+		TempDir:   flagTempDir,
+		Defaults:  defaults,
+		Headers:   header,
+
+		Repository:     flagRepository,
+		Endpoint:       flagEndpoint,
+		DefaultArch:    flagDefaultArch,
+		DefaultOS:      flagDefaultOS,
+		NoAutoLabel:    flagNoAutoLabel,
+		Ext:            flagExt,
+		RequiredLabels: flagRequireLabels,
+		MinACVersion:   flagMinACVersion,
+		MaxACVersion:   flagMaxACVersion,
+		CompressLevel:  flagCompressLevel,
+
+		TraceDiscovery:           flagTraceDiscovery,
+		LabelAnnotations:         flagLabelAnnots,
+		PrintRequests:            flagPrintRequests,
+		PayloadSchema:            flagPayloadSchema,
+		DumpManifest:             flagDumpManifest,
+		Curl:                     flagCurl,
+		TraceTiming:              flagTraceTiming,
+		Annotations:              flagAnnotations,
+		InitiationBody:           flagInitiationBody,
+		InlineManifest:           flagInlineManifest,
+		SendSize:                 flagSendSize,
+		NoProgressWhenRedirected: flagNoRedirectBar,
+		VerifyAfterPush:          flagVerifyAfterPush,
+		VerifyTimeout:            flagVerifyTimeout,
+		CompletionPollTimeout:    flagPollTimeout,
+		AlwaysAuth:               flagAlwaysAuth,
+		AllowInsecureRedirect:    flagInsecureRedir,
+		Resolver:                 flagResolver,
+		Proxy:                    flagProxy,
+		ProxyAuth:                flagProxyAuth,
+		SOCKS5:                   flagSOCKS5,
+		TLSMinVersion:            uint16(flagTLSMinVersion),
+		TLSMaxVersion:            uint16(flagTLSMaxVersion),
+		CertPins:                 flagCertPins,
+		ResumeCompletion:         flagResumeComplete,
+		CompletionStateFile:      flagCompletionState,
+		SessionFile:              flagSessionFile,
+		Resume:                   flagResume,
+		CompletionRetries:        flagCompleteRetries,
+		KeepGoing:                flagKeepGoing && !flagFailFast,
+		Parallel:                 flagParallel,
+		IdempotencyKey:           flagIdempotencyKey,
+		VerifyStreamedDigest:     flagVerifyStreamed,
+		SendDigest:               flagSendDigest,
+		NoOverwrite:              flagNoOverwrite,
+		FailOnWarning:            flagStrict,
+		Timeout:                  flagTimeout,
+		PartTimeout:              flagPartTimeout,
+		ReadBufferSize:           flagReadBufferSize,
+		Mmap:                     flagMmap,
+		ContentEncoding:          flagContentEncoding,
+		RateLimit:                flagRateLimit.global,
+		HostRateLimits:           flagRateLimit.hosts,
+		MaxConnsPerHost:          flagMaxConns,
+		DigestParts:              flagDigestParts,
+		DigestTrailer:            flagDigestTrailer,
+		ContentAddressable:       flagContentAddr,
+		Jitter:                   flagJitter,
+
 		SetHTTPHeaders: func(r *http.Request) {
 			if r.URL == nil {
 				return
 			}
-			if flagUser != "" && flagPassword != "" {
-				creds := []byte(fmt.Sprintf("%s:%s", flagUser, flagPassword))
-				encodedCreds := base64.StdEncoding.EncodeToString(creds)
-				r.Header["Authorization"] = append(r.Header["Authorization"], "Basic "+encodedCreds)
-			} else {
-				headerer, ok := conf.AuthPerHost[r.URL.Host]
-				if !ok {
-					if flagDebug {
-						fmt.Fprintf(os.Stderr, "No auth present in config for domain %s.\n", r.URL.Host)
-					}
-					return
-				}
-				header := headerer.Header()
-				for k, v := range header {
-					r.Header[k] = append(r.Header[k], v...)
+			// The headers of the file are set last, to replace any
+			// other value.
+			defer func() {
+				for k, v := range fileHeader {
+					r.Header[k] = v
 				}
+			}()
+			if r.Header.Get("Authorization") != "" {
+				// Set by the credential helper or with a
+				// token acquired.
+				return
 			}
+			authorize(r.URL.Host, r)
 		},
-	}.Upload()
+		TokenAcquirer: &lib.DockerTokenAcquirer{
+			Authorize:        authorize,
+			ForeignRealmAuth: flagRealmAuth,
+			Insecure:         flagInsecure,
+		},
+	}
 
-	if err != nil {
+	for k := range fileHeader {
+		uploader.RedactHeaders = append(uploader.RedactHeaders, k)
+	}
+	if flagConfirm {
+		uploader.Confirm = confirmPush
+	}
+	uploader.ManifestPolicy = manifestPolicy()
+	if len(flagCompleteFields) != 0 {
+		uploader.CompletionExtra = make(map[string]interface{})
+		for k, v := range flagCompleteFields {
+			uploader.CompletionExtra[k] = v
+		}
+	}
+	if flagCredHelper != "" && (flagUser == "" || flagPassword == "") {
+		uploader.Credentials = &lib.CredentialHelper{Program: flagCredHelper}
+	}
+	if flagSignKey != "" {
+		uploader.Sign = pgpSigner(flagSignKey, flagSignPassphrase, flagSignPassFile)
+	}
+	if !flagQuietSuccess {
+		uploader.CompletionMessage = func(uri, message string) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", uri, message)
+		}
+	}
+	if len(flagRewrites) > 0 {
+		uploader.URIRewriter = rewriteURI
+	}
+	if flagLogFile != "" {
+		f, err := os.OpenFile(flagLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error opening log file: %v\n", err)
+			os.Exit(2)
+		}
+		defer f.Close()
+		uploader.Log = f
+	}
+	if uploader.CompletionStateFile == "" {
+		uploader.CompletionStateFile = defaultCompletionStateFile()
+	}
+	// Sessions are only saved when asked for, so that the plain pushes
+	// leave no state behind.
+	if uploader.SessionFile == "" && flagResume {
+		uploader.SessionFile = defaultSessionFile()
+	}
+	if !flagNoDiscCache && flagDiscoveryTTL > 0 {
+		uploader.DiscoveryCacheFile = defaultDiscoveryCacheFile()
+		uploader.DiscoveryCacheTTL = flagDiscoveryTTL
+	}
+
+	uris := args[2:]
+	// The image is read for its name or its digest before being pushed,
+	// so one read from stdin or a URL is staged first, once.
+	removeStaged := func() {}
+	if len(uris) == 0 || flagSinceModified {
+		staged, remove, err := uploader.Stage()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "err: %v\n", err)
+			os.Exit(1)
+		}
+		uploader, removeStaged = staged, remove
+	}
+	defer removeStaged()
+	exit := func(code int) {
+		removeStaged()
+		os.Exit(code)
+	}
+	if len(uris) == 0 {
+		uri, err := uploader.ManifestURI()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "err: %v\n", err)
+			exit(1)
+		}
+		uris = []string{uri}
+	}
+	uploader.Uri = uris[0]
+	if flagShowDiscovery {
+		if !showDiscovery(uploader, uris) {
+			exit(1)
+		}
+		return
+	}
+
+	var (
+		state  *pushState
+		digest string
+	)
+	if flagSinceModified {
+		if state, digest, uris, err = checkModified(uploader.Acipath, uris); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		if len(uris) == 0 {
+			return
+		}
+		uploader.Uri = uris[0]
+	} else if flagIfMatch {
+		state = loadStateFile()
+	}
+	if flagIfMatch {
+		if flagNoOverwrite {
+			fmt.Fprintln(os.Stderr, "--if-match and --no-overwrite are mutually exclusive")
+			exit(1)
+		}
+		// The pushes read a copy of the ETags, as the ones of the
+		// pushes done are recorded while others are going on.
+		uploader.ETags = make(map[string]string)
+		for uri, etag := range state.ETags {
+			uploader.ETags[uri] = etag
+		}
+		var mu sync.Mutex
+		uploader.RecordETag = func(uri, etag string) {
+			mu.Lock()
+			defer mu.Unlock()
+			state.ETags[uri] = etag
+		}
+	}
+
+	var progressDone <-chan struct{}
+	if flagProgressFd >= 0 {
+		var events chan lib.UploadEvent
+		if events, progressDone, err = progressFd(flagProgressFd, flagProgressFormat, len(uris)); err != nil {
+			fmt.Fprintf(os.Stderr, "err: %v\n", err)
+			exit(1)
+		}
+		uploader.Events = events
+	}
+
+	var pushed []string
+	failed := false
+	if len(uris) > 1 {
+		pushed, failed = runMirror(uploader, uris)
+	} else if err := uploader.Upload(); err != nil {
 		fmt.Fprintf(os.Stderr, "err: %v\n", err)
-		os.Exit(1)
+		failed = true
+	} else {
+		pushed = uris
+		if flagDebug && !flagQuietSuccess {
+			fmt.Fprintln(os.Stderr, "Upload successful")
+		}
 	}
-	if flagDebug {
-		fmt.Fprintln(os.Stderr, "Upload successful")
+	if progressDone != nil {
+		// The events channel was closed by the pushes.
+		<-progressDone
+	}
+
+	if state != nil && len(pushed) > 0 {
+		if digest != "" {
+			for _, uri := range pushed {
+				state.Digests[uri] = digest
+			}
+		}
+		if err := state.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving state file: %v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		exit(1)
+	}
+}
+
+// showDiscovery prints the push endpoints discovered for every URL. It
+// returns false if discovery failed for any of them.
+func showDiscovery(uploader lib.Uploader, uris []string) bool {
+	ok := true
+	for _, uri := range uris {
+		uploader.Uri = uri
+		eps, err := uploader.DiscoverPushTemplates()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "err: %s: %v\n", uri, err)
+			ok = false
+			continue
+		}
+		fmt.Println(uri)
+		for _, ep := range eps {
+			fmt.Printf("  template: %s\n  url:      %s\n", ep.Template, ep.URL)
+		}
+	}
+	return ok
+}
+
+// rewriteURI replaces the longest prefix of uri given with --rewrite.
+func rewriteURI(uri string) string {
+	from := ""
+	for prefix := range flagRewrites {
+		if strings.HasPrefix(uri, prefix) && len(prefix) > len(from) {
+			from = prefix
+		}
+	}
+	if from == "" {
+		return uri
+	}
+	return flagRewrites[from] + strings.TrimPrefix(uri, from)
+}
+
+// checkModified loads the state file and the digest of the image, and
+// returns the URLs the image wasn't pushed to unchanged yet, unless --force
+// is given.
+func checkModified(image string, uris []string) (*pushState, string, []string, error) {
+	if flagStreaming {
+		return nil, "", nil, fmt.Errorf("--since-modified can't be used with --streaming")
+	}
+	state := loadStateFile()
+	// Pipes and devices can't be read for their digest and then pushed,
+	// they are always pushed, and no digest recorded.
+	if fi, err := os.Stat(image); err == nil && !fi.Mode().IsRegular() {
+		fmt.Fprintf(os.Stderr, "warning: %s is not a regular file, ignoring --since-modified\n", image)
+		return state, "", uris, nil
+	}
+	digest, err := fileDigest(image)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error computing the image digest: %v", err)
+	}
+	if flagForce {
+		return state, digest, uris, nil
+	}
+	var modified []string
+	for _, uri := range uris {
+		if state.Digests[uri] == digest {
+			if !flagQuietSuccess {
+				fmt.Fprintf(os.Stderr, "%s: already pushed\n", uri)
+			}
+			continue
+		}
+		modified = append(modified, uri)
+	}
+	return state, digest, modified, nil
+}
+
+// loadStateFile loads the state file given with --state-file, or the
+// default one.
+func loadStateFile() *pushState {
+	path := flagStateFile
+	if path == "" {
+		path = defaultStateFile()
+	}
+	state, err := loadPushState(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading state file: %v\n", err)
+		os.Exit(2)
+	}
+	return state
+}
+
+// runMirror pushes the image to every URL and reports the outcome of each
+// push. It returns the URLs pushed to and whether any of the pushes failed.
+func runMirror(uploader lib.Uploader, uris []string) ([]string, bool) {
+	var (
+		pushed          []string
+		failed, skipped int
+	)
+	for i, err := range uploader.UploadMirror(uris) {
+		switch err {
+		case nil:
+			if !flagQuietSuccess {
+				fmt.Fprintf(os.Stderr, "%s: upload successful\n", uris[i])
+			}
+			pushed = append(pushed, uris[i])
+		case lib.ErrNotAttempted:
+			fmt.Fprintf(os.Stderr, "%s: skipped, %v\n", uris[i], err)
+			skipped++
+		default:
+			fmt.Fprintf(os.Stderr, "err: %s: %v\n", uris[i], err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d succeeded, %d failed, %d skipped\n", len(pushed), failed, skipped)
 	}
+	return pushed, failed > 0
 }
@@ -0,0 +1,146 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/coreos/rkt/rkt/config"
+)
+
+// netrc holds the credentials read from a netrc file.
+type netrc struct {
+	machines map[string]config.BasicCredentials
+	def      *config.BasicCredentials
+}
+
+// defaultNetrcPath returns the path of the user's netrc file, or an empty
+// string if there is none.
+func defaultNetrcPath() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	path := filepath.Join(home, ".netrc")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+func loadNetrc(path string) (*netrc, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseNetrc(string(blob))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return n, nil
+}
+
+// parseNetrc parses the machine, default, login and password stanzas of a
+// netrc file. Accounts and macro definitions are skipped.
+func parseNetrc(data string) (*netrc, error) {
+	n := &netrc{machines: make(map[string]config.BasicCredentials)}
+	var (
+		cur     *config.BasicCredentials
+		machine string
+	)
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		if machine == "" {
+			n.def = cur
+		} else if _, ok := n.machines[machine]; !ok {
+			// As with other netrc readers, the first entry for a
+			// machine wins.
+			n.machines[machine] = *cur
+		}
+		cur = nil
+	}
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Fields(line)
+		for j := 0; j < len(tokens); j++ {
+			keyword := tokens[j]
+			switch keyword {
+			case "default":
+				flush()
+				cur, machine = &config.BasicCredentials{}, ""
+				continue
+			case "macdef":
+				// A macro definition runs until the next empty line.
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(tokens)
+				continue
+			}
+			if j+1 == len(tokens) {
+				return nil, fmt.Errorf("line %d: missing value for %q", i+1, keyword)
+			}
+			j++
+			value := tokens[j]
+			switch keyword {
+			case "machine":
+				flush()
+				cur, machine = &config.BasicCredentials{}, value
+			case "login", "password", "account":
+				if cur == nil {
+					return nil, fmt.Errorf("line %d: %q outside of a machine entry", i+1, keyword)
+				}
+				if keyword == "login" {
+					cur.User = value
+				} else if keyword == "password" {
+					cur.Password = value
+				}
+			default:
+				return nil, fmt.Errorf("line %d: unknown keyword %q", i+1, keyword)
+			}
+		}
+	}
+	flush()
+	return n, nil
+}
+
+// credentials returns the credentials for the given host, which may include
+// a port, falling back to the default entry.
+func (n *netrc) credentials(host string) (config.BasicCredentials, bool) {
+	if c, ok := n.machines[host]; ok {
+		return c, true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if c, ok := n.machines[h]; ok {
+			return c, true
+		}
+	}
+	if n.def != nil {
+		return *n.def, true
+	}
+	return config.BasicCredentials{}, false
+}
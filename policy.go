@@ -0,0 +1,42 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/github.com/appc/spec/schema"
+)
+
+// manifestPolicy returns the manifest policy of the --forbid-latest and
+// --require-annotation flags, or nil if neither is given.
+func manifestPolicy() func(*schema.ImageManifest) error {
+	if !flagForbidLatest && len(flagRequiredAnnots) == 0 {
+		return nil
+	}
+	return func(im *schema.ImageManifest) error {
+		if flagForbidLatest {
+			if version, ok := im.Labels.Get("version"); !ok || version == "latest" {
+				return fmt.Errorf("the version of the image is missing or latest")
+			}
+		}
+		for _, name := range flagRequiredAnnots {
+			if _, ok := im.Annotations.Get(name); !ok {
+				return fmt.Errorf("the image has no %s annotation", name)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/appc/acpush/lib"
+)
+
+// progressFd writes the progress of the ACI uploads to the file descriptor
+// fd, for progress UIs reading it, as lines of the percentage sent, or of
+// the bytes sent and their total with the bytes format, -1 if the total
+// isn't known. The pushes of a mirror are summed. It returns the channel of
+// the events of the pushes, and a channel closed once they were written.
+func progressFd(fd int, format string, pushes int) (chan lib.UploadEvent, <-chan struct{}, error) {
+	if format != "percent" && format != "bytes" {
+		return nil, nil, fmt.Errorf("unknown progress format %q, expected percent or bytes", format)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if f == nil {
+		return nil, nil, fmt.Errorf("invalid progress file descriptor %d", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, nil, fmt.Errorf("invalid progress file descriptor %d: %v", fd, err)
+	}
+
+	events := make(chan lib.UploadEvent)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sent := make(map[string]int64)
+		size := int64(-1)
+		last := ""
+		for e := range events {
+			if e.Part != "ACI" || (e.Kind != lib.PartProgress && e.Kind != lib.PartComplete) {
+				continue
+			}
+			size = e.Size
+			sent[e.URI] = e.Sent
+			if e.Kind == lib.PartComplete && e.Size >= 0 {
+				sent[e.URI] = e.Size
+			}
+			var total, n int64
+			for _, s := range sent {
+				n += s
+			}
+			if size >= 0 {
+				total = size * int64(pushes)
+			} else {
+				total = -1
+			}
+
+			var line string
+			switch {
+			case format == "bytes":
+				line = fmt.Sprintf("%d/%d\n", n, total)
+			case total > 0:
+				line = fmt.Sprintf("%d\n", n*100/total)
+			default:
+				continue
+			}
+			if line != last {
+				// Write errors are ignored, as the reader going away
+				// doesn't stop the push.
+				f.WriteString(line)
+				last = line
+			}
+		}
+	}()
+	return events, done, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/appc/acpush/Godeps/_workspace/src/golang.org/x/crypto/openpgp"
+	"github.com/appc/acpush/Godeps/_workspace/src/golang.org/x/crypto/openpgp/packet"
+)
+
+// pgpSigner returns a function making armored detached signatures with the
+// private key in the file at keyPath, unlocked with the given passphrase or
+// the one in the file at passphraseFile.
+func pgpSigner(keyPath, passphrase, passphraseFile string) func(r io.Reader) ([]byte, error) {
+	return func(r io.Reader) ([]byte, error) {
+		if passphraseFile != "" {
+			b, err := ioutil.ReadFile(passphraseFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading the passphrase: %v", err)
+			}
+			passphrase = strings.TrimRight(string(b), "\r\n")
+		}
+		signer, err := readSigningKey(keyPath, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		var sig bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&sig, signer, r, nil); err != nil {
+			return nil, err
+		}
+		return sig.Bytes(), nil
+	}
+}
+
+// readSigningKey reads the first private key of the armored or binary
+// keyring at path, decrypting it with the passphrase if needed.
+func readSigningKey(path, passphrase string) (*openpgp.Entity, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(blob))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(blob))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the key: %v", err)
+	}
+	for _, e := range keyring {
+		if e.PrivateKey == nil {
+			continue
+		}
+		keys := []*packet.PrivateKey{e.PrivateKey}
+		for _, sub := range e.Subkeys {
+			if sub.PrivateKey != nil {
+				keys = append(keys, sub.PrivateKey)
+			}
+		}
+		for _, key := range keys {
+			if !key.Encrypted {
+				continue
+			}
+			if passphrase == "" {
+				return nil, errors.New("the key is encrypted, a passphrase is needed")
+			}
+			if err := key.Decrypt([]byte(passphrase)); err != nil {
+				return nil, fmt.Errorf("error decrypting the key: %v", err)
+			}
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("no private key found in %s", path)
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// pushState records the digest of the image last pushed to each URL, for
+// --since-modified to skip pushing unchanged images, and the ETag returned by
+// the push, for --if-match to send it back.
+type pushState struct {
+	path    string
+	Digests map[string]string `json:"digests"`
+	ETags   map[string]string `json:"etags,omitempty"`
+}
+
+// defaultStateFile returns the path of the state file used when none is
+// given with --state-file.
+func defaultStateFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".acpush", "state.json")
+}
+
+// defaultCompletionStateFile returns the path of the file where failed
+// completions are saved when none is given with --completion-state-file.
+func defaultCompletionStateFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".acpush", "completions.json")
+}
+
+// defaultSessionFile returns the path of the file where the sessions of the
+// pushes are saved when none is given with --session-file.
+func defaultSessionFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".acpush", "sessions.json")
+}
+
+// defaultDiscoveryCacheFile returns the path of the file where the push
+// endpoints discovered are cached.
+func defaultDiscoveryCacheFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".acpush", "discovery.json")
+}
+
+// loadPushState reads the state file at path. A missing file holds no
+// state.
+func loadPushState(path string) (*pushState, error) {
+	state := &pushState{path: path, Digests: make(map[string]string), ETags: make(map[string]string)}
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if state.Digests == nil {
+		state.Digests = make(map[string]string)
+	}
+	if state.ETags == nil {
+		state.ETags = make(map[string]string)
+	}
+	return state, nil
+}
+
+// save writes the state back to its file, replacing it atomically so that
+// an interrupted write doesn't lose the previous state.
+func (s *pushState) save() error {
+	blob, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(blob, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// fileDigest returns the SHA-256 digest of the file at path.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !finfo.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}